@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	banFile             = "datafiles/bans.json"
+	defaultShutdownTime = 10
+	shutdownTimeout     = 10 * time.Second
+)
+
+// passwords made by resetpass leave out letters and digits that are easily
+// mistaken for each other when read out.
+const (
+	resetPasswordChars = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	resetPasswordLen   = 10
+)
+
+type ban struct {
+	Name  string    `json:"name"`
+	By    string    `json:"by"`
+	Added time.Time `json:"added"`
+}
+
+type bans struct {
+	Users      []*ban `json:"users"`
+	Sites      []*ban `json:"sites"`
+	sync.Mutex `json:"-"`
+}
+
+var banList *bans
+
+func loadBans(banPath string) error {
+	banList = &bans{}
+
+	data, err := ioutil.ReadFile(banPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return json.Unmarshal(data, banList)
+}
+
+func (b *bans) SaveToFile(savePath string) error {
+	b.Lock()
+	data, err := json.MarshalIndent(b, "", "\t")
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(savePath), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(savePath, data, 0600)
+}
+
+// UserBanned reports whether the named user is banned.
+func (b *bans) UserBanned(name string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, current := range b.Users {
+		if strings.EqualFold(current.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// SiteBanned reports whether a host is banned. a ban ending in '.' or '*'
+// covers every address starting with it.
+func (b *bans) SiteBanned(host string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, current := range b.Sites {
+		site := strings.TrimSuffix(current.Name, "*")
+		if host == site || (strings.HasSuffix(site, ".") && strings.HasPrefix(host, site)) {
+			return true
+		}
+	}
+	return false
+}
+
+func findBan(list []*ban, name string) int {
+	for i, current := range list {
+		if strings.EqualFold(current.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// site is the address the user is connected from, without the port.
+func (u *User) site() string {
+	addr := u.Conn.RemoteAddr()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func cmdKill(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: kill <user>\n")
+		return false
+	}
+
+	target, err := userList.FindByUserName(inpstr)
+	if err != nil {
+		u.Write(notloggedon + "\n")
+		return false
+	}
+	if target == u {
+		u.Write("Trying to commit suicide this way is the sixth sign of madness.\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	level := u.Level
+	u.Unlock()
+	target.Lock()
+	targetLevel := target.Level
+	recap := target.Recap
+	target.Unlock()
+
+	if targetLevel >= level {
+		u.Write("You cannot kill a user of equal or higher level than yourself.\n")
+		target.Write(fmt.Sprintf("%s~RS tried to kill you!\n", name))
+		return false
+	}
+
+	writeAudit("%s killed %s", name, inpstr)
+	target.Write("\n~FR~OLYou have been removed from this talker.\n\n")
+	target.Disconnect()
+	userList.RemoveUser(target)
+	writeWorld(&userList, nil, fmt.Sprintf("~FR~OL%s~RS~FR~OL has been removed from the talker.\n", recap))
+	return false
+}
+
+func cmdBan(u *User, inpstr string) bool {
+	fields := strings.Fields(inpstr)
+	if len(fields) == 0 {
+		listBans(u)
+		return false
+	}
+	if len(fields) != 2 || (fields[0] != "user" && fields[0] != "site") {
+		u.Write("Usage: ban [user|site <name>]\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	level := u.Level
+	u.Unlock()
+
+	if fields[0] == "user" {
+		target, err := userList.FindByUserName(fields[1])
+		if err != nil {
+			target, err = LoadUser(fields[1])
+		}
+		if err == nil {
+			target.Lock()
+			targetLevel := target.Level
+			target.Unlock()
+			if targetLevel >= level {
+				u.Write("You cannot ban a user of equal or higher level than yourself.\n")
+				return false
+			}
+		}
+	}
+
+	banList.Lock()
+	list := &banList.Users
+	if fields[0] == "site" {
+		list = &banList.Sites
+	}
+	if findBan(*list, fields[1]) != -1 {
+		banList.Unlock()
+		u.Write(fmt.Sprintf("That %s is already banned.\n", fields[0]))
+		return false
+	}
+	*list = append(*list, &ban{fields[1], name, time.Now()})
+	banList.Unlock()
+
+	err := banList.SaveToFile(banFile)
+	if err != nil {
+		fmt.Printf("unable to save bans: %s\n", err.Error())
+	}
+	writeAudit("%s banned %s %s", name, fields[0], fields[1])
+	u.Write(fmt.Sprintf("Banned %s %s.\n", fields[0], fields[1]))
+
+	//anyone already on from a banned user or site goes too
+	online := userList.online()
+
+	var banned []*User
+	for _, current := range online {
+		current.Lock()
+		currentName := current.Name
+		current.Unlock()
+		if fields[0] == "user" && strings.EqualFold(currentName, fields[1]) ||
+			fields[0] == "site" && current != u && banList.SiteBanned(current.site()) {
+			banned = append(banned, current)
+		}
+	}
+
+	for _, current := range banned {
+		current.Write("\n~FR~OLYou have been banned from this talker.\n\n")
+		current.Disconnect()
+		userList.RemoveUser(current)
+	}
+	return false
+}
+
+func cmdUnban(u *User, inpstr string) bool {
+	fields := strings.Fields(inpstr)
+	if len(fields) != 2 || (fields[0] != "user" && fields[0] != "site") {
+		u.Write("Usage: unban user|site <name>\n")
+		return false
+	}
+
+	banList.Lock()
+	list := &banList.Users
+	if fields[0] == "site" {
+		list = &banList.Sites
+	}
+	index := findBan(*list, fields[1])
+	if index == -1 {
+		banList.Unlock()
+		u.Write(fmt.Sprintf("That %s is not banned.\n", fields[0]))
+		return false
+	}
+	*list = append((*list)[:index], (*list)[index+1:]...)
+	banList.Unlock()
+
+	err := banList.SaveToFile(banFile)
+	if err != nil {
+		fmt.Printf("unable to save bans: %s\n", err.Error())
+	}
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+	writeAudit("%s unbanned %s %s", name, fields[0], fields[1])
+	u.Write(fmt.Sprintf("Unbanned %s %s.\n", fields[0], fields[1]))
+	return false
+}
+
+// cmdRename moves an account, with its backup and mail, to a new name. the
+// user has to be off the talker, or they would save over the old name again.
+func cmdRename(u *User, inpstr string) bool {
+	fields := strings.Fields(inpstr)
+	if len(fields) != 2 {
+		u.Write("Usage: rename <user> <new name>\n")
+		return false
+	}
+	oldName, newName := fields[0], fields[1]
+
+	if _, err := userList.FindByUserName(oldName); err == nil {
+		u.Write("That user is on the talker, they have to log out first.\n")
+		return false
+	}
+	if _, err := userList.FindByUserName(newName); err == nil {
+		u.Write("Someone is already using that name.\n")
+		return false
+	}
+	if err := validName(newName); err != nil {
+		u.Write(err.Error() + "\n")
+		return false
+	}
+
+	target, err := LoadUser(oldName)
+	if err != nil {
+		u.Write("There is no such user.\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	level := u.Level
+	u.Unlock()
+	target.Lock()
+	targetLevel := target.Level
+	target.Unlock()
+	if targetLevel >= level {
+		u.Write("You cannot rename a user of equal or higher level than yourself.\n")
+		return false
+	}
+
+	exists, err := userStore.Exists(newName)
+	if err == nil && exists {
+		u.Write("There is already an account with that name.\n")
+		return false
+	}
+	if err == nil {
+		//mail is moved with the account, so nothing can be delivered half way
+		mailLock.Lock()
+		err = userStore.Rename(oldName, newName)
+		mailLock.Unlock()
+	}
+	if err != nil {
+		fmt.Printf("unable to rename '%s' to '%s': %s\n", oldName, newName, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	//the saved record still has the old name inside it
+	target, err = LoadUser(newName)
+	if err == nil {
+		target.Lock()
+		target.Name = newName
+		target.Recap = newName
+		target.Unlock()
+		err = target.Save()
+	}
+	if err != nil {
+		fmt.Printf("unable to save user file for '%s': %s\n", newName, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	writeAudit("%s renamed %s to %s", name, oldName, newName)
+	u.Write(fmt.Sprintf("Renamed %s to %s.\n", oldName, newName))
+	return false
+}
+
+// cmdResetPass gives an account a new random password, for users who have
+// forgotten theirs or accounts from before passwords. the password is shown
+// to the staff member, never typed, so it doesn't end up in the input log.
+func cmdResetPass(u *User, inpstr string) bool {
+	if inpstr == "" || strings.Contains(inpstr, " ") {
+		u.Write("Usage: resetpass <user>\n")
+		return false
+	}
+
+	if _, err := userList.FindByUserName(inpstr); err == nil {
+		u.Write("That user is on the talker, they have to log out first.\n")
+		return false
+	}
+	target, err := LoadUser(inpstr)
+	if err != nil {
+		u.Write("There is no such user.\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	level := u.Level
+	u.Unlock()
+	target.Lock()
+	targetLevel := target.Level
+	target.Unlock()
+	if targetLevel >= level {
+		u.Write("You cannot reset the password of a user of equal or higher level than yourself.\n")
+		return false
+	}
+
+	password, err := randomPassword()
+	var hash []byte
+	if err == nil {
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	}
+	if err == nil {
+		target.Lock()
+		target.Password = string(hash)
+		target.Unlock()
+		err = target.Save()
+	}
+	if err != nil {
+		fmt.Printf("unable to reset the password for '%s': %s\n", inpstr, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	writeAudit("%s reset the password for %s", name, inpstr)
+	u.Write(fmt.Sprintf("The password for %s is now: ~OL%s~RS\n", inpstr, password))
+	return false
+}
+
+func randomPassword() (string, error) {
+	password := make([]byte, resetPasswordLen)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(resetPasswordChars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = resetPasswordChars[n.Int64()]
+	}
+	return string(password), nil
+}
+
+func listBans(u *User) {
+	output := "\n~OLBanned users:\n"
+	banList.Lock()
+	for _, current := range banList.Users {
+		output += fmt.Sprintf("  %-20s by %-16s %s\n", current.Name, current.By, current.Added.Format(time.ANSIC))
+	}
+	output += "\n~OLBanned sites:\n"
+	for _, current := range banList.Sites {
+		output += fmt.Sprintf("  %-20s by %-16s %s\n", current.Name, current.By, current.Added.Format(time.ANSIC))
+	}
+	banList.Unlock()
+	u.Write(output + "\n")
+}
+
+func cmdShutdown(u *User, inpstr string) bool {
+	countdown(u, inpstr, false)
+	return false
+}
+
+func cmdReboot(u *User, inpstr string) bool {
+	if inpstr == "hot" {
+		u.Lock()
+		name := u.Name
+		u.Unlock()
+		writeAudit("%s started a hot reboot", name)
+		hotReboot(u)
+		return false
+	}
+	countdown(u, inpstr, true)
+	return false
+}
+
+// countdown starts (or with "cancel" stops) a shutdown or reboot, warning
+// everyone as the time runs out.
+func countdown(u *User, inpstr string, reboot bool) {
+	action := "shutdown"
+	if reboot {
+		action = "reboot"
+	}
+
+	talkerSystem.Lock()
+	running := talkerSystem.countdown
+	if inpstr == "cancel" {
+		talkerSystem.countdown = nil
+		talkerSystem.Unlock()
+		if running == nil {
+			u.Write("There is no shutdown or reboot in progress.\n")
+			return
+		}
+		close(running)
+		writeWorld(&userList, nil, "~OLSYSTEM:~RS~FG the shutdown/reboot has been cancelled.\n")
+		return
+	}
+	if running != nil {
+		talkerSystem.Unlock()
+		u.Write(fmt.Sprintf("A shutdown or reboot is already in progress, use '.%s cancel' to stop it.\n", action))
+		return
+	}
+
+	seconds := defaultShutdownTime
+	if inpstr != "" {
+		var err error
+		seconds, err = strconv.Atoi(inpstr)
+		if err != nil || seconds < 0 {
+			talkerSystem.Unlock()
+			if reboot {
+				u.Write("Usage: reboot [<seconds>|cancel|hot]\n")
+			} else {
+				u.Write("Usage: shutdown [<seconds>|cancel]\n")
+			}
+			return
+		}
+	}
+	cancel := make(chan struct{})
+	talkerSystem.countdown = cancel
+	talkerSystem.Unlock()
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+	writeAudit("%s started a %s in %d seconds", name, action, seconds)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for remaining := seconds; remaining > 0; remaining-- {
+			if remaining == seconds || remaining%60 == 0 || remaining == 30 || remaining == 10 || remaining <= 5 {
+				writeWorld(&userList, nil, fmt.Sprintf("~OLSYSTEM:~RS~FY~OL the talker will %s in %d second(s).\n", action, remaining))
+			}
+			select {
+			case <-ticker.C:
+			case <-cancel:
+				return
+			}
+		}
+		shutdownTalker(reboot)
+	}()
+}
+
+// talkerStopping reports whether a shutdown or hot reboot has started, when
+// users are saved and closed all together rather than logged out one by one.
+func talkerStopping() bool {
+	talkerSystem.Lock()
+	defer talkerSystem.Unlock()
+	return talkerSystem.shuttingDown
+}
+
+// shutdownTalker stops taking connections, saves everyone who is logged on
+// then exits, or replaces the process with a fresh copy of itself when
+// rebooting.
+func shutdownTalker(reboot bool) {
+	talkerSystem.Lock()
+	if talkerSystem.shuttingDown {
+		talkerSystem.Unlock()
+		return
+	}
+	talkerSystem.shuttingDown = true
+	talkerSystem.Unlock()
+
+	//a stuck connection shouldn't keep the talker up forever
+	time.AfterFunc(shutdownTimeout, func() {
+		fmt.Println("shutdown timed out, exiting anyway")
+		os.Exit(1)
+	})
+
+	if mainListener != nil {
+		mainListener.Close()
+	}
+	if tlsListener != nil {
+		tlsListener.Close()
+	}
+	if sshListener != nil {
+		sshListener.Close()
+	}
+	for _, server := range []*http.Server{webServer, secureWebServer} {
+		if server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout/4)
+			server.Shutdown(ctx)
+			cancel()
+		}
+	}
+
+	if reboot {
+		writeWorld(&userList, nil, "\n~OLSYSTEM:~RS~FY~OL Rebooting now!!\n\n")
+	} else {
+		writeWorld(&userList, nil, "\n~OLSYSTEM:~RS~FR~OL Shutting down now!!\n\n")
+	}
+
+	online := userList.online()
+
+	//closing waits for queued output, so do everyone at once
+	var closing sync.WaitGroup
+	for _, u := range online {
+		err := u.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", u.Name, err.Error())
+		}
+		closing.Add(1)
+		go func(u *User) {
+			u.Close()
+			closing.Done()
+		}(u)
+	}
+	closing.Wait()
+
+	err := userStore.Close()
+	if err != nil {
+		fmt.Printf("unable to close user store: %s\n", err.Error())
+	}
+
+	if !reboot {
+		fmt.Printf("Shutdown complete %s\n", time.Now().Format(time.ANSIC))
+		os.Exit(0)
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		fmt.Printf("Rebooting %s\n", time.Now().Format(time.ANSIC))
+		err = syscall.Exec(executable, os.Args, os.Environ())
+	}
+	fmt.Printf("unable to reboot: %s\n", err.Error())
+	os.Exit(1)
+}
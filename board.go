@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const boardFiles = "datafiles/boards/"
+
+type boardMessage struct {
+	From    string    `json:"from"`
+	Posted  time.Time `json:"posted"`
+	Message string    `json:"message"`
+}
+
+type board struct {
+	Messages   []*boardMessage `json:"messages"`
+	sync.Mutex `json:"-"`
+
+	file string
+}
+
+func loadBoard(filepath string) (*board, error) {
+	b := &board{file: filepath}
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// SaveToFile writes the board out, the caller must hold the lock.
+func (b *board) SaveToFile(savePath string) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(savePath), 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(savePath, data, 0600)
+}
+
+// Unread counts the messages posted since the given time.
+func (b *board) Unread(since time.Time) int {
+	b.Lock()
+	defer b.Unlock()
+	count := 0
+	for _, message := range b.Messages {
+		if message.Posted.After(since) {
+			count++
+		}
+	}
+	return count
+}
+
+// unreadBoards describes how many new board messages there are in each room.
+func unreadBoards(u *User) string {
+	u.Lock()
+	lastRead := make(map[string]time.Time, len(u.BoardRead))
+	for name, read := range u.BoardRead {
+		lastRead[name] = read
+	}
+	u.Unlock()
+
+	var output string
+	roomListLock.Lock()
+	for _, r := range roomList {
+		if unread := r.board.Unread(lastRead[r.Name]); unread > 0 {
+			output += fmt.Sprintf("~FT~OL*** There are %d new board message(s) in the %s ***\n", unread, r.Name)
+		}
+	}
+	roomListLock.Unlock()
+	return output
+}
+
+func cmdWrite(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: write <message>\n")
+		return false
+	}
+
+	room := u.CurrentRoom()
+	u.Lock()
+	from := u.Recap
+	u.Unlock()
+
+	room.board.Lock()
+	room.board.Messages = append(room.board.Messages, &boardMessage{from, time.Now(), inpstr})
+	err := room.board.SaveToFile(room.board.file)
+	room.board.Unlock()
+	if err != nil {
+		fmt.Printf("unable to save board for '%s': %s\n", room.Name, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	u.Write("You write the message on the board.\n")
+	writeRoomExcept(&userList, room, u, fmt.Sprintf("%s~RS writes a message on the board.\n", from))
+	return false
+}
+
+func cmdRead(u *User, inpstr string) bool {
+	room := u.CurrentRoom()
+
+	room.board.Lock()
+	if len(room.board.Messages) == 0 {
+		room.board.Unlock()
+		u.Write(fmt.Sprintf("The %s message board is empty.\n", room.Name))
+		return false
+	}
+
+	output := fmt.Sprintf("\n~BB~FG*** The %s message board ***\n\n", room.Name)
+	for i, message := range room.board.Messages {
+		output += fmt.Sprintf("~FT%3d) From: %s~RS~FT  %s~RS\n     %s~RS\n\n", i+1, message.From, message.Posted.Format(time.ANSIC), message.Message)
+	}
+	room.board.Unlock()
+
+	u.Lock()
+	if u.BoardRead == nil {
+		u.BoardRead = make(map[string]time.Time)
+	}
+	u.BoardRead[room.Name] = time.Now()
+	from := u.Recap
+	u.Unlock()
+
+	u.Page(output + "~BB~FG*** End ***\n\n")
+	writeRoomExcept(&userList, room, u, fmt.Sprintf("%s~RS reads the message board.\n", from))
+	return false
+}
+
+func cmdWipe(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: wipe all|<number>[-<number>][,...]\n")
+		return false
+	}
+
+	room := u.CurrentRoom()
+
+	room.board.Lock()
+	total := len(room.board.Messages)
+	if total == 0 {
+		room.board.Unlock()
+		u.Write("The message board is empty.\n")
+		return false
+	}
+
+	selected, err := parseRange(inpstr, total)
+	if err != nil {
+		room.board.Unlock()
+		u.Write(fmt.Sprintf("There are %d message(s), usage: wipe all|<number>[-<number>][,...]\n", total))
+		return false
+	}
+
+	var kept []*boardMessage
+	for i, message := range room.board.Messages {
+		if !selected[i+1] {
+			kept = append(kept, message)
+		}
+	}
+	room.board.Messages = kept
+	err = room.board.SaveToFile(room.board.file)
+	room.board.Unlock()
+
+	if err != nil {
+		fmt.Printf("unable to save board for '%s': %s\n", room.Name, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+	writeAudit("%s wiped %d message(s) from the %s board", name, len(selected), room.Name)
+	u.Write(fmt.Sprintf("%d message(s) wiped, %d left.\n", len(selected), len(kept)))
+	return false
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// channels carry conversations outside of rooms. shout reaches everyone and
+// wiz reaches staff, other channels are made by whoever joins them first and
+// reach only their members. anyone can mute a channel without leaving it.
+const (
+	channelHistoryLines = 20
+	channelNameMax      = 16
+	channelsJoinedMax   = 10
+)
+
+type channel struct {
+	name    string
+	level   int
+	builtin bool
+	history historyBuffer
+	sync.Mutex
+}
+
+// channelMembership is saved in the user file so channels are rejoined on
+// the next login.
+type channelMembership struct {
+	Joined []string `json:"joined"`
+	Muted  []string `json:"muted"`
+}
+
+var channels = map[string]*channel{
+	"shout": {name: "shout", level: LevelUser, builtin: true, history: historyBuffer{limit: channelHistoryLines}},
+	"wiz":   {name: "wiz", level: LevelWiz, builtin: true, history: historyBuffer{limit: channelHistoryLines}},
+}
+var channelsLock sync.Mutex
+
+// findChannel looks a channel up by name, making it if create is set.
+func findChannel(name string, create bool) *channel {
+	name = strings.ToLower(name)
+	channelsLock.Lock()
+	defer channelsLock.Unlock()
+
+	c, ok := channels[name]
+	if !ok && create {
+		c = &channel{name: name, level: LevelUser, history: historyBuffer{limit: channelHistoryLines}}
+		channels[name] = c
+	}
+	return c
+}
+
+func validChannelName(name string) error {
+	if len(name) < 2 || len(name) > channelNameMax {
+		return fmt.Errorf("Channel names are 2 to %d characters long.", channelNameMax)
+	}
+	for _, char := range name {
+		if (char < 'a' || char > 'z') && (char < '0' || char > '9') {
+			return errors.New("Only letters and numbers are allowed in a channel name.")
+		}
+	}
+	return nil
+}
+
+// joinedChannel finds a channel u has joined, bringing it back if it hasn't
+// been used since a reboot.
+func (u *User) joinedChannel(name string) *channel {
+	u.Lock()
+	joined := containsName(u.Channels.Joined, name)
+	u.Unlock()
+	return findChannel(name, joined)
+}
+
+// member reports whether u can hear the channel, muted or not.
+func (c *channel) member(u *User) bool {
+	u.Lock()
+	defer u.Unlock()
+	if c.builtin {
+		return u.Level >= c.level
+	}
+	return containsName(u.Channels.Joined, c.name)
+}
+
+func (c *channel) muted(u *User) bool {
+	u.Lock()
+	defer u.Unlock()
+	return containsName(u.Channels.Muted, c.name)
+}
+
+func (c *channel) format(recap string, message string) string {
+	switch c.name {
+	case "shout":
+		return fmt.Sprintf("~OL~FY!!~RS %s~RS shouts: %s\n", recap, message)
+	case "wiz":
+		return fmt.Sprintf("~FM[wiz]~RS %s~RS: %s\n", recap, message)
+	}
+	return fmt.Sprintf("~FT[%s]~RS %s~RS: %s\n", c.name, recap, message)
+}
+
+// send puts a message on the channel from u, to every member who hasn't
+// muted it or isn't ignoring u.
+func (c *channel) send(u *User, message string) {
+	if !c.member(u) {
+		u.Write(fmt.Sprintf("You are not on the %s channel.\n", c.name))
+		return
+	}
+	if c.muted(u) {
+		u.Write(fmt.Sprintf("You have muted the %s channel, unmute it to talk on it.\n", c.name))
+		return
+	}
+
+	u.Lock()
+	name, recap := u.Name, u.Recap
+	u.Unlock()
+
+	text := c.format(recap, message)
+	c.Lock()
+	c.history.add(&messageHistory{name, time.Now(), text})
+	c.Unlock()
+
+	ev := newEvent(eventChannel, u, nil, text)
+	ev.Channel = c.name
+
+	online := userList.online()
+
+	for _, current := range online {
+		if c.member(current) && !c.muted(current) && !current.ignores(name, ignoreShouts) {
+			current.Send(ev)
+		}
+	}
+}
+
+// showHistory lists the recent messages on the channel, in the user's time.
+func (c *channel) showHistory(u *User) {
+	if !c.member(u) {
+		u.Write(fmt.Sprintf("You are not on the %s channel.\n", c.name))
+		return
+	}
+
+	location := u.location()
+	c.Lock()
+	messages := c.history.list()
+	c.Unlock()
+
+	output := fmt.Sprintf("\n~BB~FG*** Recent messages on %s ***\n\n", c.name)
+	if len(messages) == 0 {
+		u.Write(output + "Nothing has been said yet.\n")
+		return
+	}
+	for _, message := range messages {
+		output += fmt.Sprintf("~OL[%s]~RS %s", message.Time.In(location).Format("Jan 02 15:04"), message.Message)
+	}
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+}
+
+// channelCommand sends on a built in channel, or shows its history when
+// there is nothing to send.
+func channelCommand(name string) func(*User, string) bool {
+	return func(u *User, inpstr string) bool {
+		c := findChannel(name, false)
+		if inpstr == "" {
+			c.showHistory(u)
+			return false
+		}
+		c.send(u, inpstr)
+		return false
+	}
+}
+
+func cmdC(u *User, inpstr string) bool {
+	fields := strings.SplitN(inpstr, " ", 2)
+	if fields[0] == "" {
+		u.Write("Usage: c <channel> [<text>]\n")
+		return false
+	}
+
+	c := u.joinedChannel(fields[0])
+	if c == nil {
+		u.Write(fmt.Sprintf("There is no channel called %s.\n", fields[0]))
+		return false
+	}
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		c.showHistory(u)
+		return false
+	}
+	c.send(u, fields[1])
+	return false
+}
+
+func cmdChan(u *User, inpstr string) bool {
+	fields := strings.Fields(strings.ToLower(inpstr))
+	if len(fields) == 0 || fields[0] == "list" {
+		listChannels(u)
+		return false
+	}
+	if len(fields) != 2 {
+		u.Write("Usage: chan [list]|join <channel>|leave <channel>|mute <channel>\n")
+		return false
+	}
+
+	name := fields[1]
+	switch fields[0] {
+	case "join":
+		if c := findChannel(name, false); c != nil && c.builtin {
+			u.Write(fmt.Sprintf("You don't need to join the %s channel.\n", name))
+			return false
+		}
+		if err := validChannelName(name); err != nil {
+			u.Write(err.Error() + "\n")
+			return false
+		}
+
+		u.Lock()
+		if containsName(u.Channels.Joined, name) {
+			u.Unlock()
+			u.Write(fmt.Sprintf("You are already on the %s channel.\n", name))
+			return false
+		}
+		if len(u.Channels.Joined) >= channelsJoinedMax {
+			u.Unlock()
+			u.Write(fmt.Sprintf("You can only be on %d channels.\n", channelsJoinedMax))
+			return false
+		}
+		u.Channels.Joined = append(u.Channels.Joined, name)
+		u.Unlock()
+
+		findChannel(name, true)
+		u.saveAttributes()
+		u.Write(fmt.Sprintf("You join the %s channel, use 'c %s <text>' to talk on it.\n", name, name))
+	case "leave":
+		u.Lock()
+		if !containsName(u.Channels.Joined, name) {
+			u.Unlock()
+			u.Write(fmt.Sprintf("You are not on the %s channel.\n", name))
+			return false
+		}
+		u.Channels.Joined = removeName(u.Channels.Joined, name)
+		u.Channels.Muted = removeName(u.Channels.Muted, name)
+		u.Unlock()
+
+		u.saveAttributes()
+		u.Write(fmt.Sprintf("You leave the %s channel.\n", name))
+	case "mute":
+		c := u.joinedChannel(name)
+		if c == nil || !c.member(u) {
+			u.Write(fmt.Sprintf("You are not on the %s channel.\n", name))
+			return false
+		}
+
+		muted := c.muted(u)
+		u.Lock()
+		if muted {
+			u.Channels.Muted = removeName(u.Channels.Muted, name)
+		} else {
+			u.Channels.Muted = append(u.Channels.Muted, name)
+		}
+		u.Unlock()
+
+		u.saveAttributes()
+		if muted {
+			u.Write(fmt.Sprintf("You can hear the %s channel again.\n", name))
+		} else {
+			u.Write(fmt.Sprintf("You have muted the %s channel.\n", name))
+		}
+	default:
+		u.Write("Usage: chan [list]|join <channel>|leave <channel>|mute <channel>\n")
+	}
+	return false
+}
+
+func listChannels(u *User) {
+	u.Lock()
+	joined := make([]string, len(u.Channels.Joined))
+	copy(joined, u.Channels.Joined)
+	u.Unlock()
+	for _, name := range joined {
+		u.joinedChannel(name)
+	}
+
+	channelsLock.Lock()
+	var names []string
+	for name := range channels {
+		names = append(names, name)
+	}
+	channelsLock.Unlock()
+	sort.Strings(names)
+
+	online := userList.online()
+
+	output := "\n~BB~FG*** Channels ***\n\n"
+	output += fmt.Sprintf("%-*s %8s\n", channelNameMax, "Name", "Online")
+	for _, name := range names {
+		c := findChannel(name, false)
+		if c.builtin && !c.member(u) {
+			continue
+		}
+
+		count := 0
+		for _, current := range online {
+			if c.member(current) {
+				count++
+			}
+		}
+
+		var status string
+		if c.member(u) {
+			status = "~FGjoined~RS"
+			if c.muted(u) {
+				status = "~FRmuted~RS"
+			}
+		}
+		output += fmt.Sprintf("%-*s %8d %s\n", channelNameMax, name, count, status)
+	}
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+}
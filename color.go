@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// colour coded text is tokenized once into runs sharing a style, then each
+// client gets those runs rendered the way it can show them.
+
+type colorMode int
+
+const (
+	colorNone colorMode = iota
+	color16
+	color256
+	colorTrue
+	colorHTML
+)
+
+// color is unset, an entry in the 256 colour palette or an exact rgb value.
+type color struct {
+	set     bool
+	rgb     bool
+	index   uint8
+	r, g, b uint8
+}
+
+type style struct {
+	fg        color
+	bg        color
+	bold      bool
+	underline bool
+	blink     bool
+	reverse   bool
+}
+
+// colorEffect is what a colour code does to the current style. codes that
+// aren't a style change at all, like a bell, are passed through raw to
+// terminals.
+type colorEffect struct {
+	reset bool
+	set   style
+	raw   string
+}
+
+type styledText struct {
+	text  string
+	style style
+	raw   string
+}
+
+// the first 8 are the colour names used by the F? and B? codes
+var paletteNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// the standard xterm values for the first 16 palette entries
+var paletteRGB = [16][3]uint8{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+var cubeLevels = [6]uint8{0, 95, 135, 175, 215, 255}
+
+func (c color) rgbValue() (uint8, uint8, uint8) {
+	if c.rgb {
+		return c.r, c.g, c.b
+	}
+	switch {
+	case c.index < 16:
+		v := paletteRGB[c.index]
+		return v[0], v[1], v[2]
+	case c.index < 232:
+		i := c.index - 16
+		return cubeLevels[i/36], cubeLevels[i/6%6], cubeLevels[i%6]
+	}
+	grey := 8 + 10*(c.index-232)
+	return grey, grey, grey
+}
+
+// hex is the colour as #rrggbb, or its name for the basic 8.
+func (c color) hex() string {
+	if !c.rgb && c.index < 8 {
+		return paletteNames[c.index]
+	}
+	r, g, b := c.rgbValue()
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+func distance(r1, g1, b1, r2, g2, b2 uint8) int {
+	dr, dg, db := int(r1)-int(r2), int(g1)-int(g2), int(b1)-int(b2)
+	return dr*dr + dg*dg + db*db
+}
+
+// nearest finds the closest palette entry below limit, 16 or 256.
+func (c color) nearest(limit int) uint8 {
+	if !c.rgb && int(c.index) < limit {
+		return c.index
+	}
+	r, g, b := c.rgbValue()
+	best, bestDistance := 0, -1
+	for i := 0; i < limit; i++ {
+		pr, pg, pb := color{set: true, index: uint8(i)}.rgbValue()
+		if d := distance(r, g, b, pr, pg, pb); bestDistance == -1 || d < bestDistance {
+			best, bestDistance = i, d
+		}
+	}
+	return uint8(best)
+}
+
+// parseColor reads a colour name, a palette number from 0 to 255 or #RRGGBB.
+func parseColor(str string) (color, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	for i, name := range paletteNames {
+		if str == name {
+			return color{set: true, index: uint8(i)}, nil
+		}
+	}
+	if strings.HasPrefix(str, "#") {
+		return parseHexColor(str[1:])
+	}
+	index, err := strconv.Atoi(str)
+	if err != nil || index < 0 || index > 255 {
+		return color{}, fmt.Errorf("'%s' is not a colour name, 0-255 or #RRGGBB", str)
+	}
+	return color{set: true, index: uint8(index)}, nil
+}
+
+func parseHexColor(str string) (color, error) {
+	if len(str) != 6 {
+		return color{}, fmt.Errorf("'#%s' is not #RRGGBB", str)
+	}
+	value, err := strconv.ParseUint(str, 16, 32)
+	if err != nil {
+		return color{}, fmt.Errorf("'#%s' is not #RRGGBB", str)
+	}
+	return color{set: true, rgb: true, r: uint8(value >> 16), g: uint8(value >> 8), b: uint8(value)}, nil
+}
+
+// codeEffect works out what a code from colorCodes.json does. fg and bg win
+// over the escape code, which is otherwise read as an SGR sequence.
+func codeEffect(code colorCodes) (colorEffect, error) {
+	var effect colorEffect
+	if code.Fg != "" || code.Bg != "" {
+		var err error
+		if code.Fg != "" {
+			if effect.set.fg, err = parseColor(code.Fg); err != nil {
+				return effect, err
+			}
+		}
+		if code.Bg != "" {
+			if effect.set.bg, err = parseColor(code.Bg); err != nil {
+				return effect, err
+			}
+		}
+		return effect, nil
+	}
+
+	escape := code.EscapeCode
+	if !strings.HasPrefix(escape, "\x1b[") || !strings.HasSuffix(escape, "m") {
+		effect.raw = escape
+		return effect, nil
+	}
+
+	params := strings.Split(escape[2:len(escape)-1], ";")
+	for i := 0; i < len(params); i++ {
+		n, err := strconv.Atoi(params[i])
+		if params[i] == "" {
+			n, err = 0, nil
+		}
+		if err != nil {
+			effect = colorEffect{raw: escape}
+			return effect, nil
+		}
+
+		switch {
+		case n == 0:
+			effect = colorEffect{reset: true}
+		case n == 1:
+			effect.set.bold = true
+		case n == 4:
+			effect.set.underline = true
+		case n == 5:
+			effect.set.blink = true
+		case n == 7:
+			effect.set.reverse = true
+		case n >= 30 && n <= 37:
+			effect.set.fg = color{set: true, index: uint8(n - 30)}
+		case n >= 40 && n <= 47:
+			effect.set.bg = color{set: true, index: uint8(n - 40)}
+		case n >= 90 && n <= 97:
+			effect.set.fg = color{set: true, index: uint8(n - 90 + 8)}
+		case n >= 100 && n <= 107:
+			effect.set.bg = color{set: true, index: uint8(n - 100 + 8)}
+		case n == 38 || n == 48:
+			var c color
+			if i+2 < len(params) && params[i+1] == "5" {
+				index, _ := strconv.Atoi(params[i+2])
+				c = color{set: true, index: uint8(index)}
+				i += 2
+			} else if i+4 < len(params) && params[i+1] == "2" {
+				r, _ := strconv.Atoi(params[i+2])
+				g, _ := strconv.Atoi(params[i+3])
+				b, _ := strconv.Atoi(params[i+4])
+				c = color{set: true, rgb: true, r: uint8(r), g: uint8(g), b: uint8(b)}
+				i += 4
+			}
+			if n == 38 {
+				effect.set.fg = c
+			} else {
+				effect.set.bg = c
+			}
+		}
+	}
+	return effect, nil
+}
+
+func (e colorEffect) apply(s style) style {
+	if e.reset {
+		s = style{}
+	}
+	s.bold = s.bold || e.set.bold
+	s.underline = s.underline || e.set.underline
+	s.blink = s.blink || e.set.blink
+	s.reverse = s.reverse || e.set.reverse
+	if e.set.fg.set {
+		s.fg = e.set.fg
+	}
+	if e.set.bg.set {
+		s.bg = e.set.bg
+	}
+	return s
+}
+
+// findColorCode returns the longest colour code at the start of str, if
+// there is one. ~#RRGGBB sets an exact foreground colour.
+func findColorCode(str string) (int, colorEffect, bool) {
+	if strings.HasPrefix(str, "#") && len(str) >= 7 {
+		if c, err := parseHexColor(str[1:7]); err == nil {
+			return 7, colorEffect{set: style{fg: c}}, true
+		}
+	}
+
+	length := 0
+	var effect colorEffect
+	for _, code := range getColorCodes() {
+		if len(code.TextCode) > length && strings.HasPrefix(str, code.TextCode) {
+			length = len(code.TextCode)
+			effect = code.effect
+		}
+	}
+	return length, effect, length > 0
+}
+
+// tokenize splits colour coded text into runs of text sharing a style. ^~
+// is a literal ~.
+func tokenize(str string) []styledText {
+	var runs []styledText
+	var current style
+	var text []byte
+	var raw string
+
+	flush := func() {
+		if len(text) > 0 || raw != "" {
+			runs = append(runs, styledText{string(text), current, raw})
+			text = nil
+			raw = ""
+		}
+	}
+
+	for i := 0; i < len(str); i++ {
+		if str[i] == '^' && i+1 < len(str) && str[i+1] == '~' {
+			text = append(text, '~')
+			i++
+			continue
+		}
+		if str[i] != '~' {
+			text = append(text, str[i])
+			continue
+		}
+
+		length, effect, ok := findColorCode(str[i+1:])
+		if !ok {
+			text = append(text, str[i])
+			continue
+		}
+
+		flush()
+		current = effect.apply(current)
+		raw = effect.raw
+		i += length
+	}
+	flush()
+
+	return runs
+}
+
+// renderText turns colour coded text into what a client in the given mode
+// should be sent.
+func renderText(str string, mode colorMode) string {
+	runs := tokenize(str)
+	var output strings.Builder
+
+	switch mode {
+	case colorNone:
+		for _, run := range runs {
+			output.WriteString(run.text)
+		}
+	case colorHTML:
+		for _, run := range runs {
+			output.WriteString(htmlSpan(run))
+		}
+	default:
+		var previous style
+		for _, run := range runs {
+			output.WriteString(run.raw)
+			output.WriteString(sgr(previous, run.style, mode))
+			output.WriteString(run.text)
+			previous = run.style
+		}
+		//always finish on a reset so nothing bleeds into the client's prompt
+		output.WriteString("\x1b[0m")
+	}
+
+	return output.String()
+}
+
+// sgr is the escape sequence that moves a terminal from one style to another.
+func sgr(from style, to style, mode colorMode) string {
+	if from == to {
+		return ""
+	}
+
+	var params []string
+	turnedOff := (from.bold && !to.bold) || (from.underline && !to.underline) ||
+		(from.blink && !to.blink) || (from.reverse && !to.reverse) ||
+		(from.fg.set && !to.fg.set) || (from.bg.set && !to.bg.set)
+	if turnedOff {
+		params = append(params, "0")
+		from = style{}
+	}
+
+	for _, attribute := range []struct {
+		before, after bool
+		code          string
+	}{
+		{from.bold, to.bold, "1"},
+		{from.underline, to.underline, "4"},
+		{from.blink, to.blink, "5"},
+		{from.reverse, to.reverse, "7"},
+	} {
+		if attribute.after && !attribute.before {
+			params = append(params, attribute.code)
+		}
+	}
+	//colours that look the same on this terminal don't need sending again
+	if to.fg.set && (!from.fg.set || colorParams(to.fg, mode, false) != colorParams(from.fg, mode, false)) {
+		params = append(params, colorParams(to.fg, mode, false))
+	}
+	if to.bg.set && (!from.bg.set || colorParams(to.bg, mode, true) != colorParams(from.bg, mode, true)) {
+		params = append(params, colorParams(to.bg, mode, true))
+	}
+
+	if len(params) == 0 {
+		return ""
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+func colorParams(c color, mode colorMode, background bool) string {
+	base, bright, extended := 30, 90, 38
+	if background {
+		base, bright, extended = 40, 100, 48
+	}
+
+	if c.rgb && mode == colorTrue {
+		return fmt.Sprintf("%d;2;%d;%d;%d", extended, c.r, c.g, c.b)
+	}
+
+	limit := 16
+	if mode == color256 || mode == colorTrue {
+		limit = 256
+	}
+	index := c.nearest(limit)
+	switch {
+	case index < 8:
+		return strconv.Itoa(base + int(index))
+	case index < 16:
+		return strconv.Itoa(bright + int(index) - 8)
+	}
+	return fmt.Sprintf("%d;5;%d", extended, index)
+}
+
+func htmlSpan(run styledText) string {
+	text := html.EscapeString(run.text)
+	if run.style == (style{}) {
+		return text
+	}
+
+	fg, bg := run.style.fg, run.style.bg
+	var css []string
+	if run.style.reverse {
+		fg, bg = bg, fg
+		if !fg.set {
+			fg = color{set: true, index: 0}
+		}
+		if !bg.set {
+			bg = color{set: true, index: 7}
+		}
+	}
+	if fg.set {
+		css = append(css, "color:"+fg.hex())
+	}
+	if bg.set {
+		css = append(css, "background-color:"+bg.hex())
+	}
+	if run.style.bold {
+		css = append(css, "font-weight:bold")
+	}
+	var decorations []string
+	if run.style.underline {
+		decorations = append(decorations, "underline")
+	}
+	if run.style.blink {
+		decorations = append(decorations, "blink")
+	}
+	if len(decorations) > 0 {
+		css = append(css, "text-decoration:"+strings.Join(decorations, " "))
+	}
+
+	return fmt.Sprintf(`<span style="%s">%s</span>`, strings.Join(css, ";"), text)
+}
+
+// colorComStrip removes every colour code, leaving the text as it is shown.
+func colorComStrip(str string) string {
+	return renderText(str, colorNone)
+}
+
+// countColors is how many characters of str are colour codes rather than
+// text, used to pad colour coded text out to a width.
+func countColors(colorString string) int {
+	return len(colorString) - len(colorComStrip(colorString))
+}
+
+// terminalColorMode guesses what a terminal can show from its reported type.
+func terminalColorMode(termType string) colorMode {
+	switch {
+	case strings.Contains(termType, "truecolor"), strings.Contains(termType, "24bit"), strings.Contains(termType, "direct"):
+		return colorTrue
+	case strings.Contains(termType, "256"):
+		return color256
+	}
+	return color16
+}
+
+// colorPreferences are the settings for .set colour, an empty setting means
+// whatever the client supports.
+var colorPreferences = map[string]colorMode{
+	"off":  colorNone,
+	"on":   color16,
+	"256":  color256,
+	"true": colorTrue,
+}
+
+func (mode colorMode) String() string {
+	switch mode {
+	case colorNone:
+		return "off"
+	case color16:
+		return "16 colours"
+	case color256:
+		return "256 colours"
+	case colorTrue:
+		return "true colour"
+	case colorHTML:
+		return "html"
+	}
+	return "unknown"
+}
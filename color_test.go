@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+// useColorCodes swaps in a small set of colour codes for the length of a test.
+func useColorCodes(t *testing.T) {
+	codes := []colorCodes{
+		{TextCode: "RS", EscapeCode: "\x1b[0m"},
+		{TextCode: "OL", EscapeCode: "\x1b[1m"},
+		{TextCode: "FR", EscapeCode: "\x1b[31m"},
+		{TextCode: "BB", Bg: "blue"},
+	}
+	for i := range codes {
+		var err error
+		codes[i].effect, err = codeEffect(codes[i])
+		if err != nil {
+			t.Fatalf("code %s: %s", codes[i].TextCode, err)
+		}
+	}
+
+	saved := colorCodesList
+	colorCodesList = codes
+	t.Cleanup(func() { colorCodesList = saved })
+}
+
+func TestRenderText(t *testing.T) {
+	useColorCodes(t)
+
+	tests := []struct {
+		input string
+		mode  colorMode
+		want  string
+	}{
+		{"abc~", colorNone, "abc~"},
+		{"abc~", color16, "abc~\x1b[0m"},
+		{"~", colorNone, "~"},
+		{"~~FRx", colorNone, "~x"},
+		{"^~FR", colorNone, "~FR"},
+		{"^~FR", color16, "~FR\x1b[0m"},
+		{"^^~FR", colorNone, "^~FR"},
+		{"a^", colorNone, "a^"},
+		{"~FRred~RS", colorNone, "red"},
+		{"~FRred~RS", color16, "\x1b[31mred\x1b[0m"},
+		{"~FRa~OLb", color16, "\x1b[31ma\x1b[1mb\x1b[0m"},
+		{"~FRa~RSb", color16, "\x1b[31ma\x1b[0mb\x1b[0m"},
+		{"~BBx", color16, "\x1b[44mx\x1b[0m"},
+		{"~#ff00", colorNone, "~#ff00"},
+		{"~#ff00", color16, "~#ff00\x1b[0m"},
+		{"~#ff00zz", colorNone, "~#ff00zz"},
+		{"~#ff0000x", colorNone, "x"},
+		{"~#ff0000x", color16, "\x1b[91mx\x1b[0m"},
+		{"~#ff0000x", colorTrue, "\x1b[38;2;255;0;0mx\x1b[0m"},
+		{"~#d75f00x", color256, "\x1b[38;5;166mx\x1b[0m"},
+		{"~FR<b>", colorHTML, `<span style="color:red">&lt;b&gt;</span>`},
+		{"~FR~RS", colorHTML, ""},
+	}
+
+	for _, test := range tests {
+		if got := renderText(test.input, test.mode); got != test.want {
+			t.Errorf("renderText(%q, %s) = %q, want %q", test.input, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	useColorCodes(t)
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"abc~", []string{"abc~"}},
+		{"^~FR", []string{"~FR"}},
+		{"a~FRb~RSc", []string{"a", "b", "c"}},
+		{"~FR~OL", nil},
+	}
+
+	for _, test := range tests {
+		runs := tokenize(test.input)
+		var got []string
+		for _, run := range runs {
+			got = append(got, run.text)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("tokenize(%q) gave runs %q, want %q", test.input, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("tokenize(%q) gave runs %q, want %q", test.input, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCountColors(t *testing.T) {
+	useColorCodes(t)
+
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{"plain", 0},
+		{"~FRred~RS", 6},
+		{"~#ff0000x", 8},
+		{"^~FR", 1},
+	}
+
+	for _, test := range tests {
+		if got := countColors(test.input); got != test.want {
+			t.Errorf("countColors(%q) = %d, want %d", test.input, got, test.want)
+		}
+	}
+}
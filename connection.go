@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// web clients have no telnet layer, so they are told to mask their input
+// with these private escapes instead
+const (
+	webMaskOn  = "\x1b]mask;on\a"
+	webMaskOff = "\x1b]mask;off\a"
+)
+
+// Connection is a client connected over any transport. users only ever talk
+// to their connection through this, so adding a new kind of listener means
+// writing a new implementation rather than touching User.
+type Connection interface {
+	// ReadLine blocks until a whole line has been typed. errLineTooLong means
+	// a line was thrown away, the connection can still be read from.
+	ReadLine() (string, error)
+	// Write sends output that has already been rendered for this client.
+	Write(data []byte) error
+	Close() error
+	// RemoteAddr is the host:port the client connected from.
+	RemoteAddr() string
+	Capabilities() capabilities
+	// SetEcho turns the client's echo of what is typed on or off.
+	SetEcho(on bool) error
+}
+
+// capabilities describes what a client can do with the output sent to it. a
+// zero width or height means the client never said.
+type capabilities struct {
+	Color    colorMode
+	JSON     bool
+	Width    int
+	Height   int
+	TermType string
+	// Paged clients need long output split into screens.
+	Paged bool
+	// AskColor is set when the client gives no hint of whether it shows
+	// colour, so the user is asked when they log in.
+	AskColor bool
+}
+
+// telnetConn is a raw socket speaking telnet, or near enough. the embedded
+// lock guards the telnet state and writeLock keeps writes whole, so the state
+// can still be read while a write is stuck on a slow client.
+type telnetConn struct {
+	conn      net.Conn
+	telnet    *telnet
+	lines     lineReader
+	buffer    []byte
+	writeLock sync.Mutex
+	sync.Mutex
+
+	// reply sends negotiation and echo commands, straight to the socket
+	// until an output queue takes them over.
+	reply func(data []byte) error
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	c := &telnetConn{conn: conn, telnet: newTelnet(), buffer: make([]byte, 2048)}
+	c.reply = c.Write
+	return c
+}
+
+func (c *telnetConn) sendRepliesTo(write func(data []byte) error) {
+	c.Lock()
+	c.reply = write
+	c.Unlock()
+}
+
+func (c *telnetConn) ReadLine() (string, error) {
+	return c.lines.next(func() ([]byte, error) {
+		n, err := c.conn.Read(c.buffer)
+		c.Lock()
+		data, reply := c.telnet.parse(c.buffer[:n])
+		send := c.reply
+		c.Unlock()
+		if len(reply) > 0 {
+			send(reply)
+		}
+		return data, err
+	})
+}
+
+func (c *telnetConn) Write(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *telnetConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *telnetConn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *telnetConn) Capabilities() capabilities {
+	c.Lock()
+	defer c.Unlock()
+	return capabilities{
+		Color:    terminalColorMode(c.telnet.termType),
+		Width:    c.telnet.width,
+		Height:   c.telnet.height,
+		TermType: c.telnet.termType,
+		Paged:    true,
+		AskColor: c.telnet.termType == "",
+	}
+}
+
+func (c *telnetConn) SetEcho(on bool) error {
+	var command []byte
+	c.Lock()
+	if on {
+		command = c.telnet.echoOn()
+	} else {
+		command = c.telnet.echoOff()
+	}
+	send := c.reply
+	c.Unlock()
+	return send(command)
+}
+
+// webConn is a browser on the other end of a websocket. each message is at
+// least one line, json clients wrap theirs in {"text": "..."}.
+type webConn struct {
+	conn  *websocket.Conn
+	json  bool
+	html  bool
+	lines lineReader
+	sync.Mutex
+}
+
+func newWebConn(conn *websocket.Conn) *webConn {
+	return &webConn{conn: conn, json: wantsJSON(conn), html: wantsHTML(conn)}
+}
+
+func (c *webConn) ReadLine() (string, error) {
+	return c.lines.next(func() ([]byte, error) {
+		var text string
+		err := websocket.Message.Receive(c.conn, &text)
+		if err != nil {
+			return nil, err
+		}
+		if c.json {
+			text = jsonInput(text)
+		}
+		if !strings.HasSuffix(text, "\n") && !strings.HasSuffix(text, "\r") {
+			text += "\n"
+		}
+		return []byte(text), nil
+	})
+}
+
+func (c *webConn) Write(data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	return websocket.Message.Send(c.conn, string(data))
+}
+
+func (c *webConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *webConn) RemoteAddr() string {
+	return c.conn.Request().RemoteAddr
+}
+
+func (c *webConn) Capabilities() capabilities {
+	if c.html {
+		return capabilities{Color: colorHTML, JSON: c.json}
+	}
+	return capabilities{Color: color16, JSON: c.json}
+}
+
+func (c *webConn) SetEcho(on bool) error {
+	//json clients are told to mask input by the prompt itself
+	if c.json {
+		return nil
+	}
+	if on {
+		return c.Write([]byte(webMaskOff))
+	}
+	return c.Write([]byte(webMaskOn))
+}
+
+// capabilities is what the connection says it can do, overridden by
+// anything the user has set for themselves.
+func (u *User) capabilities() capabilities {
+	caps := u.Conn.Capabilities()
+
+	u.Lock()
+	preference, width, height := u.Color, u.TermWidth, u.TermHeight
+	u.Unlock()
+
+	//web clients keep their own rendering, they can only turn it off
+	if mode, ok := colorPreferences[preference]; ok && (caps.Color != colorHTML || mode == colorNone) {
+		caps.Color = mode
+	}
+	if width > 0 {
+		caps.Width = width
+	}
+	if height > 0 {
+		caps.Height = height
+	}
+	return caps
+}
+
+// Width is the terminal width reported by the client, or a sensible default.
+func (u *User) Width() int {
+	width := u.capabilities().Width
+	if width < minWidth {
+		return defaultWidth
+	}
+	return width
+}
+
+func (u *User) Height() int {
+	height := u.capabilities().Height
+	if height == 0 {
+		return defaultHeight
+	}
+	return height
+}
+
+// showAttributes lists what the user has set with .set and what is being
+// used because of it.
+func showAttributes(u *User) {
+	caps := u.capabilities()
+	u.Lock()
+	recap, preference, width, height, timezone := u.Recap, u.Color, u.TermWidth, u.TermHeight, u.Timezone
+	u.Unlock()
+
+	setting := func(value string) string {
+		if value == "" || value == "0" {
+			return "auto"
+		}
+		return value
+	}
+
+	output := "\n~BB~FG*** Your attributes ***\n\n"
+	output += fmt.Sprintf("recap    : %s~RS\n", recap)
+	output += fmt.Sprintf("colour   : %-5s (%s)\n", setting(preference), caps.Color)
+	output += fmt.Sprintf("width    : %-5s (%d)\n", setting(strconv.Itoa(width)), u.Width())
+	output += fmt.Sprintf("height   : %-5s (%d)\n", setting(strconv.Itoa(height)), u.Height())
+	output += fmt.Sprintf("timezone : %-5s (%s)\n", setting(timezone), time.Now().In(u.location()).Format("15:04 MST"))
+	output += "\nUse 'set <attribute> <value>' to change one, 'auto' goes back to what your client reports.\n"
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+}
+
+func setColor(u *User, value string) {
+	value = strings.ToLower(value)
+	if value == "auto" {
+		value = ""
+	} else if _, ok := colorPreferences[value]; !ok {
+		u.Write("Usage: set colour on|off|256|true|auto\n")
+		return
+	}
+
+	u.Lock()
+	u.Color = value
+	u.Unlock()
+	u.saveAttributes()
+	u.Write(fmt.Sprintf("~OLColour~RS is now %s.\n", u.capabilities().Color))
+}
+
+func setTimezone(u *User, value string) {
+	if value == "" {
+		u.Write("Usage: set timezone <zone, like Europe/London>|auto\n")
+		return
+	}
+	if value == "auto" {
+		value = ""
+	} else if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+		u.Write(fmt.Sprintf("'%s' is not a timezone, try one like Europe/London or America/New_York.\n", value))
+		return
+	}
+
+	u.Lock()
+	u.Timezone = value
+	u.Unlock()
+	u.saveAttributes()
+	u.Write(fmt.Sprintf("Your time is now %s.\n", time.Now().In(u.location()).Format("15:04 MST")))
+}
+
+func setSize(u *User, attribute string, value string) {
+	least, most := minWidth, maxWidth
+	if attribute == "height" {
+		least, most = minHeight, maxHeight
+	}
+
+	size := 0
+	if value != "auto" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || size < least || size > most {
+			u.Write(fmt.Sprintf("Usage: set %s <%d-%d>|auto\n", attribute, least, most))
+			return
+		}
+	}
+
+	u.Lock()
+	if attribute == "height" {
+		u.TermHeight = size
+	} else {
+		u.TermWidth = size
+	}
+	u.Unlock()
+	u.saveAttributes()
+
+	if attribute == "height" {
+		u.Write(fmt.Sprintf("Your height is now %d lines.\n", u.Height()))
+	} else {
+		u.Write(fmt.Sprintf("Your width is now %d columns.\n", u.Width()))
+	}
+}
+
+func (u *User) saveAttributes() {
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+
+	err := u.Save()
+	if err != nil {
+		fmt.Printf("unable to save user file for '%s': %s \n", name, err.Error())
+	}
+}
+
+// asksColor is true for clients that never said what terminal they are,
+// and whose user hasn't chosen a colour setting yet.
+func (u *User) asksColor() bool {
+	if !u.Conn.Capabilities().AskColor {
+		return false
+	}
+	u.Lock()
+	defer u.Unlock()
+	return u.Color == ""
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a hot reboot hands the listening sockets and every telnet connection to a
+// freshly started copy of the talker. the new process finds them through the
+// state file named in copyoverEnv. web connections can't be handed over, so
+// those users are given a token to log straight back in with. ssh sessions
+// can't be handed over either and have to reconnect by hand.
+const (
+	copyoverEnv     = "GOTALKER_COPYOVER"
+	copyoverFile    = "datafiles/copyover.json"
+	reconnectWindow = 2 * time.Minute
+	firstPassedFile = 3
+	webReconnect    = "\x1b]reconnect;%s\a"
+)
+
+type copyoverSession struct {
+	Name      string    `json:"name"`
+	Room      string    `json:"room"`
+	LastInput time.Time `json:"last_input"`
+	File      int       `json:"file"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	TermType  string    `json:"term_type"`
+	Token     string    `json:"token,omitempty"`
+}
+
+type copyoverState struct {
+	Listeners map[string]int     `json:"listeners"`
+	Sessions  []*copyoverSession `json:"sessions"`
+}
+
+// handover is the state left by the previous process during a hot reboot.
+var handover *copyoverState
+
+var reconnectTokens = make(map[string]*copyoverSession)
+var reconnectLock sync.Mutex
+
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// hotReboot starts a new copy of the talker, handing it everyone who is
+// logged on, then exits.
+func hotReboot(u *User) {
+	talkerSystem.Lock()
+	if talkerSystem.shuttingDown {
+		talkerSystem.Unlock()
+		u.Write("A shutdown or reboot is already in progress.\n")
+		return
+	}
+	talkerSystem.shuttingDown = true
+	talkerSystem.Unlock()
+
+	err := startCopyover()
+	if err != nil {
+		talkerSystem.Lock()
+		talkerSystem.shuttingDown = false
+		talkerSystem.Unlock()
+		fmt.Printf("hot reboot failed: %s\n", err.Error())
+		u.Write(fmt.Sprintf("Hot reboot failed: %s\n", err.Error()))
+		writeWorld(&userList, nil, "~OLSYSTEM:~RS~FG the hot reboot has been cancelled.\n")
+		return
+	}
+
+	fmt.Printf("Hot reboot handed over %s\n", time.Now().Format(time.ANSIC))
+	os.Exit(0)
+}
+
+func startCopyover() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	state := &copyoverState{Listeners: make(map[string]int)}
+	for name, listener := range openListeners() {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("the %s listener cannot be passed on", name)
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		state.Listeners[name] = firstPassedFile + len(files)
+		files = append(files, f)
+	}
+
+	writeWorld(&userList, nil, "\n~OLSYSTEM:~RS~FY~OL Hot reboot in progress, hold on...\n\n")
+
+	online := userList.online()
+
+	type webUser struct {
+		user  *User
+		token string
+	}
+	var webUsers []webUser
+	var dropped []*User
+	var handed []*net.TCPConn
+	for _, current := range online {
+		err := current.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", current.Name, err.Error())
+		}
+
+		current.Lock()
+		session := &copyoverSession{Name: current.Name, LastInput: current.LastInput}
+		if current.Room != nil {
+			session.Room = current.Room.Name
+		}
+		current.Unlock()
+
+		var tcp *net.TCPConn
+		switch client := transport(current.Conn).(type) {
+		case *telnetConn:
+			//tls sessions can't be handed over
+			var ok bool
+			if tcp, ok = client.conn.(*net.TCPConn); !ok {
+				dropped = append(dropped, current)
+				continue
+			}
+			caps := client.Capabilities()
+			session.Width = caps.Width
+			session.Height = caps.Height
+			session.TermType = caps.TermType
+		case *webConn:
+		default:
+			dropped = append(dropped, current)
+			continue
+		}
+
+		var f *os.File
+		if tcp != nil {
+			//anything still queued has to go out before the socket changes hands
+			if q, ok := current.Conn.(*outputQueue); ok {
+				q.flush(outputFlushTimeout)
+			}
+			f, err = tcp.File()
+		}
+		if tcp == nil || err != nil {
+			//fall back to a token the client can reconnect with
+			session.File = -1
+			session.Token, err = newToken()
+			if err != nil {
+				return err
+			}
+			webUsers = append(webUsers, webUser{current, session.Token})
+		} else {
+			session.File = firstPassedFile + len(files)
+			files = append(files, f)
+			handed = append(handed, tcp)
+		}
+		state.Sessions = append(state.Sessions, session)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(copyoverFile, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), copyoverEnv+"="+copyoverFile)
+	cmd.ExtraFiles = files
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	//the new process can't open the store until it has been let go of here
+	userStore.Close()
+	err = cmd.Start()
+	if err != nil {
+		os.Remove(copyoverFile)
+		cfg := getConfig()
+		if reopened, openErr := openUserStore(cfg.UserStore, cfg.UserStorePath); openErr == nil {
+			userStore = reopened
+		} else {
+			fmt.Printf("unable to reopen user store: %s\n", openErr.Error())
+		}
+		return err
+	}
+
+	//the new process owns the sockets now. shuttingDown has been set since
+	//the start, so nothing here logs anyone out or reads their input
+	for _, listener := range openListeners() {
+		listener.Close()
+	}
+	//only this process's copy is closed, the new process keeps the socket
+	for _, tcp := range handed {
+		tcp.Close()
+	}
+
+	//each close waits for its queue to drain, so they are all done together
+	var wg sync.WaitGroup
+	closeConn := func(u *User) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.Close()
+		}()
+	}
+	for _, web := range webUsers {
+		ev := newEvent(eventReconnect, nil, nil, fmt.Sprintf(webReconnect, web.token))
+		if web.user.Conn.Capabilities().JSON {
+			ev.Text = "Reconnecting...\n"
+			ev.Token = web.token
+		}
+		web.user.Send(ev)
+		closeConn(web.user)
+	}
+	for _, current := range dropped {
+		current.Write("Your connection could not be kept, please reconnect.\n")
+		closeConn(current)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// openListeners names every listener that is currently accepting connections.
+func openListeners() map[string]net.Listener {
+	listeners := make(map[string]net.Listener)
+	for name, listener := range map[string]net.Listener{
+		"main":  mainListener,
+		"web":   webListener,
+		"ssh":   sshListener,
+		"tls":   tlsListener,
+		"https": httpsListener,
+	} {
+		if listener != nil {
+			listeners[name] = listener
+		}
+	}
+	return listeners
+}
+
+// readCopyover loads the state left behind by the previous process.
+func readCopyover(statePath string) (*copyoverState, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+
+	state := &copyoverState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// listen opens a listening socket on port, or picks up the one passed on by
+// the previous process during a hot reboot. a port of 0 leaves it switched off.
+func listen(name string, port int) (net.Listener, error) {
+	if port == 0 {
+		return nil, nil
+	}
+	if handover != nil {
+		if fd, ok := handover.Listeners[name]; ok {
+			f := os.NewFile(uintptr(fd), name+" listener")
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	return net.Listen("tcp", ":"+strconv.Itoa(port))
+}
+
+// restoreCopyover logs everyone handed over by a hot reboot back in.
+func restoreCopyover(state *copyoverState) {
+	for _, session := range state.Sessions {
+		if session.File == -1 {
+			reconnectLock.Lock()
+			reconnectTokens[session.Token] = session
+			reconnectLock.Unlock()
+			continue
+		}
+
+		f := os.NewFile(uintptr(session.File), session.Name)
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			fmt.Printf("unable to restore connection for '%s': %s\n", session.Name, err.Error())
+			continue
+		}
+
+		client := newTelnetConn(conn)
+		client.telnet.width = session.Width
+		client.telnet.height = session.Height
+		client.telnet.termType = session.TermType
+
+		u, _ := NewUser()
+		u.Conn = newOutputQueue(client)
+
+		if restoreSession(u, session) {
+			go readInput(u)
+		}
+	}
+
+	time.AfterFunc(reconnectWindow, func() {
+		reconnectLock.Lock()
+		reconnectTokens = make(map[string]*copyoverSession)
+		reconnectLock.Unlock()
+	})
+}
+
+// takeReconnectToken returns the session a token was issued for. tokens can
+// only be used once.
+func takeReconnectToken(token string) *copyoverSession {
+	reconnectLock.Lock()
+	defer reconnectLock.Unlock()
+	session, ok := reconnectTokens[token]
+	if !ok {
+		return nil
+	}
+	delete(reconnectTokens, token)
+	return session
+}
+
+// restoreSession puts a user handed over by a hot reboot back where they were.
+func restoreSession(u *User, session *copyoverSession) bool {
+	err := u.Load(session.Name)
+	if err != nil {
+		fmt.Printf("unable to load user file for '%s': %s\n", session.Name, err.Error())
+		u.Write(fmt.Sprintf("\n%s: unable to load your account.\n\n", syserror))
+		u.Close()
+		return false
+	}
+
+	room, err := roomList.FindByName(session.Room)
+	if err != nil {
+		room = mainRoom
+	}
+
+	u.Lock()
+	u.Login = LoginLogged
+	u.Room = room
+	u.LastInput = session.LastInput
+	u.Unlock()
+
+	talkerSystem.Lock()
+	talkerSystem.OnlineCount++
+	talkerSystem.Unlock()
+	userList.AddUser(u)
+
+	u.Write("\n~OL~FY*** Reality shifts around you... ***\n\n")
+	return true
+}
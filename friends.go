@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// friends are people a user wants to keep track of. they are told when a
+// friend comes or goes and can see or message all of them at once.
+const friendsMax = 50
+
+func (u *User) isFriend(name string) bool {
+	u.Lock()
+	defer u.Unlock()
+	return containsName(u.Friends, name)
+}
+
+// onlineFriends returns everyone logged on that u has as a friend.
+func onlineFriends(u *User) []*User {
+	online := userList.online()
+
+	var friends []*User
+	for _, current := range online {
+		if current == u {
+			continue
+		}
+		current.Lock()
+		name := current.Name
+		current.Unlock()
+		if u.isFriend(name) {
+			friends = append(friends, current)
+		}
+	}
+	return friends
+}
+
+// notifyFriends tells everyone who has u as a friend that they have logged
+// in or out.
+func notifyFriends(u *User, loggedIn bool) {
+	u.Lock()
+	name, recap := u.Name, u.Recap
+	u.Unlock()
+
+	message := fmt.Sprintf("~FG~OL[Friend]~RS %s~RS has logged out.\n", recap)
+	if loggedIn {
+		message = fmt.Sprintf("~FG~OL[Friend]~RS %s~RS has logged in.\n", recap)
+	}
+
+	online := userList.online()
+
+	for _, current := range online {
+		if current != u && current.isFriend(name) && !current.ignores(name, ignoreSpeech) {
+			current.Write(message)
+		}
+	}
+}
+
+func cmdFriend(u *User, inpstr string) bool {
+	fields := strings.Fields(inpstr)
+	if len(fields) == 0 || fields[0] == "list" {
+		u.Lock()
+		friends := make([]string, len(u.Friends))
+		copy(friends, u.Friends)
+		u.Unlock()
+
+		if len(friends) == 0 {
+			u.Write("You have no friends listed.\n")
+			return false
+		}
+		u.Write("\n~BB~FG*** Your friends ***\n\n" + helpColumns(friends, (u.Width()-1)/11) + "\n~BB~FG*** End ***\n\n")
+		return false
+	}
+	if len(fields) != 2 || (fields[0] != "add" && fields[0] != "remove") {
+		u.Write("Usage: friend [list]|add <user>|remove <user>\n")
+		return false
+	}
+
+	name := fields[1]
+	if fields[0] == "remove" {
+		u.Lock()
+		if i := indexName(u.Friends, name); i != -1 {
+			friend := u.Friends[i]
+			u.Friends = removeName(u.Friends, name)
+			u.Unlock()
+			u.saveAttributes()
+			u.Write(fmt.Sprintf("%s is no longer on your friends list.\n", friend))
+			return false
+		}
+		u.Unlock()
+		u.Write(fmt.Sprintf("%s is not on your friends list.\n", name))
+		return false
+	}
+
+	u.Lock()
+	self := strings.EqualFold(u.Name, name)
+	total := len(u.Friends)
+	u.Unlock()
+
+	if self {
+		u.Write("You are already your own best friend.\n")
+		return false
+	}
+	if u.isFriend(name) {
+		u.Write(fmt.Sprintf("%s is already on your friends list.\n", name))
+		return false
+	}
+	if total >= friendsMax {
+		u.Write(fmt.Sprintf("You can only have %d friends listed.\n", friendsMax))
+		return false
+	}
+
+	name, exists := resolveAccountName(name)
+	if !exists {
+		u.Write("There is no one of that name.\n")
+		return false
+	}
+
+	u.Lock()
+	u.Friends = append(u.Friends, name)
+	u.Unlock()
+	u.saveAttributes()
+	u.Write(fmt.Sprintf("%s is now on your friends list.\n", name))
+	return false
+}
+
+func cmdFwho(u *User, inpstr string) bool {
+	friends := onlineFriends(u)
+	if len(friends) == 0 {
+		u.Write("None of your friends are logged on.\n")
+		return false
+	}
+
+	output := "\n~BB~FG*** Your friends online ***\n\n"
+	output += fmt.Sprintf("%-*s %-16s %10s\n", userNameLenMax, "Name", "Room", "Idle")
+	for _, friend := range friends {
+		status := friend.idleStatus()
+		friend.Lock()
+		name := friend.Name
+		idle := time.Since(friend.LastInput).Round(time.Second)
+		roomName := ""
+		if friend.Room != nil {
+			roomName = friend.Room.Name
+		}
+		friend.Unlock()
+		output += fmt.Sprintf("%-*s %-16s %10s %s\n", userNameLenMax, name, roomName, idle, status)
+	}
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+	return false
+}
+
+// cmdFtell sends one message to every friend who is logged on.
+func cmdFtell(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: ftell <text>\n")
+		return false
+	}
+
+	friends := onlineFriends(u)
+	if len(friends) == 0 {
+		u.Write("None of your friends are logged on.\n")
+		return false
+	}
+
+	now := time.Now()
+	u.Lock()
+	senderName, senderRecap := u.Name, u.Recap
+	u.Unlock()
+
+	received := fmt.Sprintf("~FG[Friends]~RS %s~RS tells you: %s\n", senderRecap, inpstr)
+	var told []string
+	for _, friend := range friends {
+		if friend.ignores(senderName, ignoreTells) {
+			continue
+		}
+		friend.Lock()
+		friend.PastTells.add(&messageHistory{senderName, now, received})
+		told = append(told, friend.Recap+"~RS")
+		friend.Unlock()
+		friend.Send(newEvent(eventTell, u, nil, received))
+	}
+
+	if len(told) == 0 {
+		u.Write("None of your friends logged on will take tells from you.\n")
+		return false
+	}
+
+	sent := fmt.Sprintf("you tell your friends (%s): %s\n", strings.Join(told, ", "), inpstr)
+	u.Lock()
+	u.PastTells.add(&messageHistory{"friends", now, sent})
+	u.Unlock()
+	u.Send(newEvent(eventTell, u, nil, sent))
+	return false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,12 +13,14 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/websocket"
 )
 
@@ -34,6 +37,8 @@ const (
 	userNameMin    = 3
 	userNameLenMax = 16
 	recapNameMax   = userNameLenMax*4 + 3
+	userPasswdMin  = 3
+	loginAttempts  = 3
 )
 
 const (
@@ -42,18 +47,31 @@ const (
 	LoginPasswd
 	LoginConfirm
 	LoginPrompt
-	SocketTypeNetwork = iota
-	SocketTypeWebSocket
+	LoginColor
 )
 
 //var connections []net.Conn
 type config struct {
-	Mainport      int  `json:"main_port"`
-	Webport       int  `json:"web_port"`
-	MaxUsers      int  `json:"max_users"`
-	LoginIdleTime int  `json:"login_idle_time"`
-	UserIdleTime  int  `json:"user_idle_time"`
-	StopLogins    bool `json:"stop_logins"`
+	Mainport      int    `json:"main_port"`
+	Webport       int    `json:"web_port"`
+	TLSPort       int    `json:"tls_port"`
+	HTTPSPort     int    `json:"https_port"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	MaxUsers      int    `json:"max_users"`
+	LoginIdleTime int    `json:"login_idle_time"`
+	LoginAttempts int    `json:"login_attempts"`
+	UserIdleTime  int    `json:"user_idle_time"`
+	SSHPort       int    `json:"ssh_port"`
+	SSHHostKey    string `json:"ssh_host_key"`
+	IdleWarnTime  int    `json:"idle_warn_time"`
+	IdleExempt    string `json:"idle_exempt_level"`
+	UserStore     string `json:"user_store"`
+	UserStorePath string `json:"user_store_path"`
+	NewUserLevel  string `json:"new_user_level"`
+	ClaimAccounts bool   `json:"claim_passwordless_accounts"`
+	StopLogins    bool   `json:"stop_logins"`
+	MainRoom      string `json:"main_room"`
 }
 
 type system struct {
@@ -62,34 +80,81 @@ type system struct {
 	Motd1Count  int
 	Motd2Count  int
 	sync.Mutex
+
+	countdown    chan struct{}
+	shuttingDown bool
 }
 
+// colorCodes maps a code typed after a '~' to what it does. the escape code
+// is read as an ANSI SGR sequence, or fg and bg can name a colour instead as
+// one of the 8 colour names, a 256 colour palette number or #RRGGBB.
 type colorCodes struct {
 	TextCode   string `json:"textCode"`
-	EscapeCode string `json:"escapeCode"`
-}
+	EscapeCode string `json:"escapeCode,omitempty"`
+	Fg         string `json:"fg,omitempty"`
+	Bg         string `json:"bg,omitempty"`
 
-type messageHistory struct {
-	user    string
-	event   time.Time
-	message string
+	effect colorEffect
 }
 
+// the config, colour codes and command templates are replaced whole on a
+// SIGHUP while everyone is using them, so outside of booting they are only
+// touched under reloadLock.
 var colorCodesList []colorCodes
 
 var commandTemplates map[string]*template.Template
 
+var reloadLock sync.RWMutex
+
+func getConfig() *config {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return talkerConfig
+}
+
+func getColorCodes() []colorCodes {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return colorCodesList
+}
+
+func getCommandTemplate(name string) (*template.Template, bool) {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	t, ok := commandTemplates[name]
+	return t, ok
+}
+
 type User struct {
-	Name        string          `json:"name"`
-	Recap       string          `json:"recap"`
-	Description string          `json:"description"`
-	Login       uint8           `json:"-"`
-	Socket      net.Conn        `json:"-"`
-	WebSocket   *websocket.Conn `json:"-"`
-	LastInput   time.Time       `json:"last_input"`
-	SocketType  uint8           `json:"-"`
-	PastTells   []*messageHistory
+	Version     int                  `json:"version"`
+	Name        string               `json:"name"`
+	Recap       string               `json:"recap"`
+	Description string               `json:"description"`
+	Password    string               `json:"password"`
+	Level       int                  `json:"level"`
+	Login       uint8                `json:"-"`
+	Conn        Connection           `json:"-"`
+	LastInput   time.Time            `json:"last_input"`
+	Room        *Room                `json:"-"`
+	BoardRead   map[string]time.Time `json:"board_read"`
+	SSHKeys     []string             `json:"ssh_keys"`
+	Color       string               `json:"color"`
+	TermWidth   int                  `json:"width"`
+	TermHeight  int                  `json:"height"`
+	Timezone    string               `json:"timezone"`
+	Ignore      ignoreList           `json:"ignore"`
+	Friends     []string             `json:"friends"`
+	Channels    channelMembership    `json:"channels"`
+	PastTells   historyBuffer        `json:"past_tells"`
 	sync.Mutex  `json:"-"`
+
+	attempts     int
+	disconnected bool
+	idleWarned   bool
+	afk          bool
+	afkMessage   string
+	pager        []string
+	pagerTotal   int
 }
 
 func NewUser() (*User, error) {
@@ -98,45 +163,75 @@ func NewUser() (*User, error) {
 	return &u, nil
 }
 
-func LoadFromFile(filepath string) (*User, error) {
+// LoadUser reads a saved account from the user store.
+func LoadUser(name string) (*User, error) {
 	u := &User{}
 
-	data, err := ioutil.ReadFile(filepath)
+	err := u.Load(name)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, u)
+	return u, nil
+}
 
+// Load reads a saved account over the top of u, leaving the connection alone.
+func (u *User) Load(name string) error {
+	data, err := userStore.Get(name)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return u, nil
+	upgraded, err := upgradeUser(data)
+	if err != nil && !errors.Is(err, errNewerUserFile) {
+		upgraded, err = recoverUser(name, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	u.Lock()
+	err = json.Unmarshal(upgraded, u)
+	u.Unlock()
+
+	return err
 }
 
 func (u *User) Disconnect() {
+	//shutdowns and hot reboots save and close everyone at once
+	if talkerStopping() {
+		return
+	}
+
 	var site string
 	var name string
 	var loginState uint8
 	u.Lock()
-	if u.SocketType == SocketTypeWebSocket {
-		site = u.WebSocket.RemoteAddr().String()
-	} else {
-		site = u.Socket.RemoteAddr().String()
+	if u.disconnected {
+		u.Unlock()
+		return
 	}
+	u.disconnected = true
+	site = u.Conn.RemoteAddr()
 	name = u.Recap
 	loginState = u.Login
 	u.Unlock()
 
-	if loginState == 0 {
-		u.Write("\nYou are removed from this reality...\n\n")
-		u.Write(fmt.Sprintf("You were logged on from site %s\n", site))
-		writeWorld(userList, fmt.Sprintf("[Leaving is: %s]\n", name))
+	if loginState != LoginLogged {
+		u.Close()
+		talkerSystem.Lock()
+		talkerSystem.LoginCount--
+		talkerSystem.Unlock()
+		return
 	}
+
+	u.Write("\nYou are removed from this reality...\n\n")
+	u.Write(fmt.Sprintf("You were logged on from site %s\n", site))
+	writeWorld(&userList, u, fmt.Sprintf("[Leaving is: %s]\n", name))
+	notifyFriends(u, false)
 	u.Close()
 
-	err := u.SaveToFile(userFiles + u.Name + ".json")
+	err := u.Save()
 	if err != nil {
 		fmt.Printf("unable to save user file for '%s': %s \n", u.Name, err.Error())
 	}
@@ -145,103 +240,79 @@ func (u *User) Disconnect() {
 	talkerSystem.Unlock()
 }
 
+// Write sends text to the user, expanding colour codes for terminals.
 func (u *User) Write(str string) {
-	var output []rune
-	wait := 0
-
-	//what's the better way to do this? too many cases.. not well thought out
-	for index, char := range str {
-		if wait > 0 {
-			wait--
-			continue
-		}
-
-		if char == '^' && len(str) < index+1 && str[index+1] == '~' {
-			output = append(output, char)
-			output = append(output, '~')
-			wait = 1
-		} else if char == '~' {
-			colorFind := str[index+1 : index+3]
-			foundCode := false
-
-			for i := 0; i < len(colorCodesList); i++ {
-				if colorFind == colorCodesList[i].TextCode {
-					output = append(output, []rune(colorCodesList[i].EscapeCode)...)
-					foundCode = true
-					wait = 2
-					break
-				}
-			}
-
-			if foundCode == false {
-				output = append(output, char)
-			}
-		} else {
-			output = append(output, char)
-		}
+	if u.Conn.Capabilities().JSON {
+		u.Send(newEvent(eventSystem, nil, nil, str))
+		return
 	}
+	u.writeText(str)
+}
 
-	//0 is assumed to be the escape character
-	output = append(output, []rune(colorCodesList[0].EscapeCode)...)
+func (u *User) writeText(str string) {
+	u.Conn.Write([]byte(renderText(str, u.capabilities().Color)))
+}
 
-	u.Lock()
-	//more will be added to this over time
-	if u.SocketType == SocketTypeWebSocket {
-		websocket.Message.Send(u.WebSocket, string(output))
-		//u.WebSocket.Write([]byte(str))
-	} else {
-		u.Socket.Write([]byte(string(output)))
-	}
-	u.Unlock()
+// echoOff asks the client to stop echoing input, used while a password is typed.
+func (u *User) echoOff() {
+	u.Conn.SetEcho(false)
+}
+
+func (u *User) echoOn() {
+	u.Conn.SetEcho(true)
 }
 
-func (u *User) SaveToFile(savePath string) error {
+// Save writes u to the user store.
+func (u *User) Save() error {
+	u.Lock()
+	name := u.Name
+	u.Version = userFileVersion
 	data, err := json.Marshal(u)
+	u.Unlock()
 	if err != nil {
 		return err
 	}
 
-	_, err = os.Stat(path.Dir(savePath))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-		if err = os.Mkdir(path.Dir(savePath), 0700); err != nil {
-			return err
-		}
-	}
+	return userStore.Put(name, data)
+}
 
-	err = ioutil.WriteFile(savePath, data, 0600)
-	if err != nil {
-		return err
+// Tell sends a private message from u to recipient, keeping it in both of
+// their tell histories. only one of them is locked at a time, so two people
+// telling each other at once can't deadlock. it returns false if the
+// recipient is ignoring u.
+func (u *User) Tell(recipient *User, message string) bool {
+	now := time.Now()
+
+	u.Lock()
+	senderName, senderRecap := u.Name, u.Recap
+	u.Unlock()
+
+	if recipient.ignores(senderName, ignoreTells) {
+		recipient.Lock()
+		recipientRecap := recipient.Recap
+		recipient.Unlock()
+		u.Write(fmt.Sprintf("%s~RS is ignoring you.\n", recipientRecap))
+		return false
 	}
 
-	return nil
-}
+	recipient.Lock()
+	recipientName, recipientRecap := recipient.Name, recipient.Recap
+	received := fmt.Sprintf("%s tells you~RS: %s\n", senderRecap, message)
+	recipient.PastTells.add(&messageHistory{senderName, now, received})
+	recipient.Unlock()
 
-func (u *User) Tell(fromUser *User, message string) {
 	u.Lock()
-	fromUser.Lock()
-	fullMessage := fmt.Sprintf("%s tells you~RS: %s\n", u.Recap, message)
-	fullFromMessage := fmt.Sprintf("you tell %s~RS: %s\n", fromUser.Recap, message)
-
-	u.PastTells = append(u.PastTells, &messageHistory{fromUser.Name, time.Now(), fullFromMessage})
-	fromUser.PastTells = append(fromUser.PastTells, &messageHistory{u.Name, time.Now(), fullMessage})
-	fromUser.Unlock()
+	sent := fmt.Sprintf("you tell %s~RS: %s\n", recipientRecap, message)
+	u.PastTells.add(&messageHistory{recipientName, now, sent})
 	u.Unlock()
 
-	fromUser.Write(fullMessage)
-	u.Write(fullFromMessage)
+	recipient.Send(newEvent(eventTell, u, nil, received))
+	u.Send(newEvent(eventTell, u, nil, sent))
+	return true
 }
 
 func (u *User) Close() {
-	u.Lock()
-	if u.SocketType == SocketTypeWebSocket {
-		u.WebSocket.Close()
-	} else {
-		u.Socket.Close()
-	}
-	u.Unlock()
+	u.Conn.Close()
 }
 
 type users []*User
@@ -269,6 +340,20 @@ func (ulist *users) RemoveUser(u *User) {
 		*ulist = append((*ulist)[:connIndex], (*ulist)[connIndex+1:]...)
 	}
 	userListLock.Unlock()
+
+	if connIndex > -1 {
+		sendWhoUpdate()
+	}
+}
+
+// online takes a copy of the list to work through, so nobody is skipped or
+// seen twice if someone leaves part way.
+func (ulist *users) online() []*User {
+	userListLock.Lock()
+	defer userListLock.Unlock()
+	online := make([]*User, len(*ulist))
+	copy(online, *ulist)
+	return online
 }
 
 func (ulist *users) FindByUserName(username string) (*User, error) {
@@ -289,42 +374,170 @@ func (ulist *users) FindByUserName(username string) (*User, error) {
 	return foundUser, nil
 }
 
-var commands map[string]func(*User, string) bool
+// resolveAccountName is name as the account has it, and whether there is an
+// account of that name at all, on the talker or saved.
+func resolveAccountName(name string) (string, bool) {
+	if other, err := userList.FindByUserName(name); err == nil {
+		other.Lock()
+		defer other.Unlock()
+		return other.Name, true
+	}
+	exists, _ := userStore.Exists(name)
+	return name, exists
+}
+
+var commands map[string]*command
 var talkerSystem *system
 var talkerConfig *config
 
+var configLocation string
+var mainListener net.Listener
+var webListener net.Listener
+var webServer *http.Server
+var secureWebServer *http.Server
+
+func loadConfig(configPath string) (*config, error) {
+	readContents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open config file: %s", err.Error())
+	}
+
+	newConfig := &config{}
+	err = json.Unmarshal(readContents, newConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s", err.Error())
+	}
+
+	return newConfig, nil
+}
+
+func loadColorCodes(colorPath string) ([]colorCodes, error) {
+	var codes []colorCodes
+
+	readContents, err := ioutil.ReadFile(colorPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(readContents, &codes)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range codes {
+		codes[i].effect, err = codeEffect(codes[i])
+		if err != nil {
+			return nil, fmt.Errorf("color code '%s': %s", codes[i].TextCode, err.Error())
+		}
+	}
+
+	return codes, nil
+}
+
 func main() {
-	var configLocation string
+	if len(os.Args) > 1 && os.Args[1] == "migrate-store" {
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: gotalker migrate-store <from> <to>")
+			fmt.Println("where each store is json[:directory] or bolt[:file]")
+			os.Exit(1)
+		}
+		if err := migrateStore(os.Args[2], os.Args[3]); err != nil {
+			fmt.Printf("unable to migrate users: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "set-level" {
+		if len(os.Args) != 4 && len(os.Args) != 5 {
+			fmt.Println("Usage: gotalker set-level <user> <level> [<config file>]")
+			fmt.Printf("where level is one of %s\n", strings.Join(levelNames, ", "))
+			os.Exit(1)
+		}
+		configLocation = configFile
+		if len(os.Args) == 5 {
+			configLocation = os.Args[4]
+		}
+
+		var err error
+		talkerConfig, err = loadConfig(configLocation)
+		if err == nil {
+			userStore, err = openUserStore(talkerConfig.UserStore, talkerConfig.UserStorePath)
+		}
+		if err == nil {
+			err = setLevel(os.Args[2], os.Args[3])
+			userStore.Close()
+		}
+		if err != nil {
+			fmt.Printf("unable to set level: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	if len(os.Args) > 1 {
 		configLocation = os.Args[1]
 	} else {
 		configLocation = configFile
 	}
 
-	readContents, err := ioutil.ReadFile(configLocation)
 	publicDirectory := "public"
 
 	fmt.Printf("Parsing config file '%s'...\n", configLocation)
+	var err error
+	talkerConfig, err = loadConfig(configLocation)
 	if err != nil {
-		panic(fmt.Sprintf("Cannot open config file: %s", err.Error()))
+		panic(err.Error())
 	}
 
-	err = json.Unmarshal(readContents, &talkerConfig)
+	userStore, err = openUserStore(talkerConfig.UserStore, talkerConfig.UserStorePath)
 	if err != nil {
-		panic(fmt.Sprintf("Unable to read config file: %s", err.Error()))
+		log.Fatal(fmt.Sprintf("unable to open user store: %s", err.Error()))
 	}
 
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(talkerConfig.Mainport))
+	if copyover := os.Getenv(copyoverEnv); copyover != "" {
+		handover, err = readCopyover(copyover)
+		if err != nil {
+			fmt.Printf("unable to read hot reboot state: %s\n", err.Error())
+		}
+	}
+
+	mainListener, err = listen("main", talkerConfig.Mainport)
+	if err == nil {
+		webListener, err = listen("web", talkerConfig.Webport)
+	}
 
 	if err != nil {
 		fmt.Println("error setting up socket")
 	}
 
+	if tlsEnabled() {
+		err = loadCertificate(talkerConfig.TLSCert, talkerConfig.TLSKey)
+		if err == nil {
+			tlsListener, err = listen("tls", talkerConfig.TLSPort)
+		}
+		if err == nil {
+			httpsListener, err = listen("https", talkerConfig.HTTPSPort)
+		}
+		if err != nil {
+			fmt.Printf("unable to set up tls: %s\n", err.Error())
+		}
+	}
+
+	if talkerConfig.SSHPort != 0 {
+		sshConfig, err = loadSSHConfig(talkerConfig.SSHHostKey)
+		if err == nil {
+			sshListener, err = listen("ssh", talkerConfig.SSHPort)
+		}
+		if err != nil {
+			fmt.Printf("unable to set up ssh: %s\n", err.Error())
+		}
+	}
+
 	userList = users{}
 	talkerSystem = &system{}
 
-	readContents, err = ioutil.ReadFile(colorCodeFile)
-	err = json.Unmarshal(readContents, &colorCodesList)
+	colorCodesList, err = loadColorCodes(colorCodeFile)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("unable to read color codes: %s", err.Error()))
 	}
@@ -333,9 +546,27 @@ func main() {
 	fmt.Printf(" GoTalker server booting %s\n", time.Now().Format(time.ANSIC))
 	fmt.Println("|-------------------------------------------------------------|")
 
+	fmt.Println("Loading rooms")
+	err = loadRooms(roomFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("There are %d rooms, logins go to the %s\n", len(roomList), mainRoom.Name)
+
+	fmt.Println("Loading bans")
+	err = loadBans(banFile)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("unable to load bans: %s", err.Error()))
+	}
+
 	fmt.Println("Parsing command structure")
-	commands = map[string]func(*User, string) bool{
-		"desc": func(u *User, inpstr string) bool {
+	commands = map[string]*command{
+		"afk":    {LevelNew, cmdAfk},
+		"ban":    {LevelArch, cmdBan},
+		"c":      {LevelUser, cmdC},
+		"chan":   {LevelUser, cmdChan},
+		"demote": {LevelWiz, cmdDemote},
+		"desc": {LevelNew, func(u *User, inpstr string) bool {
 			u.Lock()
 			currentDescription := u.Description
 			u.Unlock()
@@ -353,69 +584,95 @@ func main() {
 			u.Unlock()
 			u.Write("Description set.\n")
 			return false
-		},
-		"help": func(u *User, inpstr string) bool {
-			u.Write("\n+----------------------------------------------------------------------------+\n")
-			u.Write("   All commands start with a '.'                                                \n")
-			u.Write("+----------------------------------------------------------------------------+\n")
-
-			var output string
-			count := 0
-			for key := range commands {
-				count++
-				output += fmt.Sprintf("%11s", key)
-
-				if count%5 == 0 {
-					output += "\n"
+		}},
+		"dmail":  {LevelNew, cmdDmail},
+		"emote":  {LevelNew, cmdEmote},
+		"friend": {LevelUser, cmdFriend},
+		"ftell":  {LevelUser, cmdFtell},
+		"fwho":   {LevelUser, cmdFwho},
+		"go":     {LevelNew, cmdGo},
+		"help": {LevelNew, func(u *User, inpstr string) bool {
+			width := u.Width()
+			line := "+" + strings.Repeat("-", width-3) + "+\n"
+			columns := (width - 1) / 11
+			u.Write("\n" + line)
+			u.Write("   All commands start with a '.'\n")
+			u.Write(line)
+
+			u.Lock()
+			level := u.Level
+			u.Unlock()
+
+			var names []string
+			var socialNames []string
+			for key, com := range commands {
+				if level < com.level {
+					continue
+				}
+				if _, ok := socials[key]; ok {
+					socialNames = append(socialNames, key)
+				} else {
+					names = append(names, key)
 				}
 			}
-			if count%5 != 0 {
-				output += "\n"
+
+			u.Write(helpColumns(names, columns))
+			if len(socialNames) > 0 {
+				u.Write(line)
+				u.Write("   Socials, use them with or without a user name\n")
+				u.Write(line)
+				u.Write(helpColumns(socialNames, columns))
 			}
-			u.Write(output)
-			u.Write("+----------------------------------------------------------------------------+\n")
-			u.Write(fmt.Sprintf(" There is a total of %d commands that you can use\n", count))
-			u.Write("+----------------------------------------------------------------------------+\n")
+			u.Write(line)
+			u.Write(fmt.Sprintf(" There is a total of %d commands that you can use\n", len(names)+len(socialNames)))
+			u.Write(line)
 			return false
-		},
-		"quit": func(u *User, inpstr string) bool {
+		}},
+		"ignore":     {LevelNew, cmdIgnore},
+		"kill":       {LevelWiz, cmdKill},
+		"listignore": {LevelNew, cmdListIgnore},
+		"look":       {LevelNew, cmdLook},
+		"promote":    {LevelWiz, cmdPromote},
+		"queues":     {LevelWiz, cmdQueues},
+		"quit": {LevelNew, func(u *User, inpstr string) bool {
 			u.Disconnect()
 			userList.RemoveUser(u)
 			return true
-		},
-		"revtell": func(u *User, inpstr string) bool {
-			u.Write("\n~BB~FG*** Your Tell buffer ***\n")
-			if len(u.PastTells) == 0 {
-				u.Write("Revtell buffer is empty.\n")
-				return false
-			}
-
-			var tellHistory string
-			u.Lock()
-			for _, tellMessage := range u.PastTells {
-				tellHistory += tellMessage.message
-			}
-			u.Unlock()
-			u.Write(tellHistory)
-			u.Write("\n~BB~FG*** End ***\n\n")
-			return false
-		},
-		"say": func(u *User, inpstr string) bool {
+		}},
+		"revtell":   {LevelNew, cmdRevtell},
+		"reboot":    {LevelGod, cmdReboot},
+		"rename":    {LevelArch, cmdRename},
+		"resetpass": {LevelArch, cmdResetPass},
+		"read":      {LevelNew, cmdRead},
+		"rmail":     {LevelNew, cmdRmail},
+		"rooms":     {LevelNew, cmdRooms},
+		"say": {LevelNew, func(u *User, inpstr string) bool {
 			if inpstr != "" {
-				writeWorld(userList, u.Recap+" says: "+inpstr+"\n")
+				u.Lock()
+				name := u.Recap
+				room := u.Room
+				u.Unlock()
+				sendRoom(&userList, room, newEvent(eventSay, u, room, name+" says: "+inpstr+"\n"))
 			}
 			return false
-		},
-		"set": func(u *User, inpstr string) bool {
-			spaceIndex := strings.Index(inpstr, " ")
-			if spaceIndex == -1 {
-				u.Write("set recap: set recap <name as you would like it.\n")
-				//show attributes
+		}},
+		"set": {LevelNew, func(u *User, inpstr string) bool {
+			if inpstr == "" {
+				showAttributes(u)
 				return false
 			}
-			subCommand := inpstr[:spaceIndex]
-			afterCommand := inpstr[spaceIndex+1:]
+			subCommand, afterCommand := inpstr, ""
+			if spaceIndex := strings.Index(inpstr, " "); spaceIndex != -1 {
+				subCommand = inpstr[:spaceIndex]
+				afterCommand = strings.TrimSpace(inpstr[spaceIndex+1:])
+			}
 			switch subCommand {
+			case "colour", "color":
+				setColor(u, afterCommand)
+			case "width", "height":
+				setSize(u, subCommand, afterCommand)
+			case "timezone":
+				setTimezone(u, afterCommand)
 			case "recap":
 				if afterCommand == "" {
 					u.Write("Usage: set recap <name as you would like it.\n")
@@ -440,11 +697,13 @@ func main() {
 				u.Recap = afterCommand + "~RS"
 				u.Unlock()
 				u.Write(fmt.Sprintf("Your name will now appear as '%s~RS' on the 'who', 'examine', tells, etc\n", afterCommand))
+			default:
+				u.Write("Usage: set [recap|colour|width|height|timezone] <value>\n")
 			}
 
 			return false
-		},
-		"tell": func(u *User, inpstr string) bool {
+		}},
+		"tell": {LevelNew, func(u *User, inpstr string) bool {
 			if inpstr == "" {
 				//TODO: review tells
 				u.Write("Usage tell <user> <text>\n")
@@ -470,47 +729,79 @@ func main() {
 					u.Write("Talking to yourself is the first sign of madness\n")
 					return false
 				}
-				u.Tell(otherUser, message)
+				if !u.Tell(otherUser, message) {
+					return false
+				}
+
+				otherUser.Lock()
+				afk, afkMessage := otherUser.afk, otherUser.afkMessage
+				otherUser.Unlock()
+				if afk && afkMessage != "" {
+					u.Write(fmt.Sprintf("%s is AFK: %s\n", userName, afkMessage))
+				} else if afk {
+					u.Write(fmt.Sprintf("%s is AFK at the moment.\n", userName))
+				}
 			}
 
 			return false
-		},
-		"think": func(u *User, inpstr string) bool {
+		}},
+		"shout":    {LevelUser, channelCommand("shout")},
+		"shutdown": {LevelGod, cmdShutdown},
+		"smail":    {LevelUser, cmdSmail},
+		"sshkey":   {LevelUser, cmdSSHKey},
+		"think": {LevelNew, func(u *User, inpstr string) bool {
 			var name string
+			var room *Room
 			u.Lock()
 			name = u.Recap
+			room = u.Room
 			u.Unlock()
 
 			if inpstr == "" {
-				writeWorld(userList, fmt.Sprintf("%s thinks nothing--now that is just typical!\n", name))
+				sendRoom(&userList, room, newEvent(eventEmote, u, room, fmt.Sprintf("%s thinks nothing--now that is just typical!\n", name)))
 			} else {
-				writeWorld(userList, fmt.Sprintf("%s thinks . o O ( %s )\n", name, inpstr))
+				sendRoom(&userList, room, newEvent(eventEmote, u, room, fmt.Sprintf("%s thinks . o O ( %s )\n", name, inpstr)))
 			}
 			return false
-		},
-		"who": func(u *User, inpstr string) bool {
-			whoTemplate, ok := commandTemplates["who"]
+		}},
+		"topic": {LevelUser, cmdTopic},
+		"unban": {LevelArch, cmdUnban},
+		"wipe":  {LevelWiz, cmdWipe},
+		"wiz":   {LevelWiz, channelCommand("wiz")},
+		"write": {LevelUser, cmdWrite},
+		"who": {LevelNew, func(u *User, inpstr string) bool {
+			whoTemplate, ok := getCommandTemplate("who")
 			type smallUser struct {
 				Name        string
 				Recap       string
 				Description string
+				Room        string
+				Level       string
 				DiffString  string
+				Status      string
 			}
 
 			var whoStruct = struct {
 				UserTotal int
+				Width     int
 				UserList  []smallUser
 			}{}
+			whoStruct.Width = u.Width()
 
 			if !ok {
 				u.Write("unable to find who template for display")
 			}
 			userListLock.Lock()
 			for _, currentUser := range userList {
+				status := currentUser.idleStatus()
 				currentUser.Lock()
 				timeDifference := time.Since(currentUser.LastInput)
 				diffString := time.Duration((timeDifference / time.Second) * time.Second).String()
-				whoStruct.UserList = append(whoStruct.UserList, smallUser{currentUser.Name, currentUser.Recap, currentUser.Description, diffString})
+				roomName := ""
+				if currentUser.Room != nil {
+					roomName = currentUser.Room.Name
+				}
+				whoStruct.UserList = append(whoStruct.UserList, smallUser{currentUser.Name, currentUser.Recap, currentUser.Description, roomName, levelName(currentUser.Level), diffString, status})
 				currentUser.Unlock()
 			}
 			whoStruct.UserTotal = len(userList)
@@ -522,36 +813,76 @@ func main() {
 			if err != nil {
 				u.Write(fmt.Sprintf("template error: %s", err.Error()))
 			}
-			u.Write(output.String())
+			u.Page(output.String())
 			return false
-		},
+		}},
+	}
+	fmt.Println("Loading socials")
+	err = loadSocials(socialsFile)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("unable to load socials: %s", err.Error()))
 	}
+	fmt.Printf("There are %d socials\n", len(socials))
+
 	fmt.Printf("Parsing command templates\n")
-	loadCommandTemplates(comTemplates)
+	err = loadCommandTemplates(comTemplates)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	countMotds(motdFiles)
 	fmt.Printf("There %d login motds and %d post-login motds\n", talkerSystem.Motd1Count, talkerSystem.Motd2Count)
 
 	fmt.Println("Setting up web layer")
 	http.Handle("/", http.FileServer(http.Dir(publicDirectory)))
-	http.Handle("/com", websocket.Handler(acceptWebConnection))
-	fmt.Printf("Initialising weblayer on: %d\n", talkerConfig.Webport)
-	fmt.Printf("Initialising socket on port: %d\n", talkerConfig.Mainport)
+	http.Handle("/com", websocket.Server{Handler: acceptWebConnection, Handshake: webHandshake})
+	if webListener != nil {
+		fmt.Printf("Initialising weblayer on: %d\n", talkerConfig.Webport)
+	}
+	if httpsListener != nil {
+		fmt.Printf("Initialising secure weblayer on: %d\n", talkerConfig.HTTPSPort)
+	}
+	if mainListener != nil {
+		fmt.Printf("Initialising socket on port: %d\n", talkerConfig.Mainport)
+	}
+	if tlsListener != nil {
+		fmt.Printf("Initialising tls socket on port: %d\n", talkerConfig.TLSPort)
+	}
+	if sshListener != nil {
+		fmt.Printf("Initialising ssh on port: %d\n", talkerConfig.SSHPort)
+	}
 	fmt.Println("|-------------------------------------------------------------|")
 	fmt.Printf(" Booted with PID %d\n", os.Getpid())
 	fmt.Println("\\-------------------------------------------------------------/")
 
-	go http.ListenAndServe(":"+strconv.Itoa(talkerConfig.Webport), nil)
-	for {
-		conn, err := ln.Accept()
+	go handleSignals()
+	go idleSweeper()
 
-		if err != nil {
-			fmt.Println("unable to accept socket", err)
-			continue
-		}
+	if handover != nil {
+		fmt.Println("Restoring sessions from hot reboot")
+		restoreCopyover(handover)
+	}
 
-		go acceptHTTPConnection(conn)
+	if webListener != nil {
+		webServer = &http.Server{Addr: ":" + strconv.Itoa(getConfig().Webport)}
+		go webServer.Serve(webListener)
+	}
+	if httpsListener != nil {
+		secureWebServer = &http.Server{Addr: ":" + strconv.Itoa(getConfig().HTTPSPort), TLSConfig: tlsConfig}
+		go secureWebServer.ServeTLS(httpsListener, "", "")
+	}
+	if mainListener != nil {
+		go serveTelnet(mainListener)
+	}
+	if tlsListener != nil {
+		go serveTelnet(tls.NewListener(tlsListener, tlsConfig))
+	}
+	if sshListener != nil {
+		go serveSSH(sshListener)
 	}
+
+	//everything is served from here on, shutdownTalker exits once everyone is saved
+	select {}
 }
 
 func acceptWebConnection(conn *websocket.Conn) {
@@ -561,8 +892,18 @@ func acceptWebConnection(conn *websocket.Conn) {
 		conn.Close()
 		fmt.Printf("[acceptConnection] User Creation error: %s", err.Error())
 	}
-	u.WebSocket = conn
-	u.SocketType = SocketTypeWebSocket
+	u.Conn = newOutputQueue(newWebConn(conn))
+
+	//back from a hot reboot
+	if token := conn.Request().URL.Query().Get("token"); token != "" {
+		if session := takeReconnectToken(token); session != nil {
+			if restoreSession(u, session) {
+				readInput(u)
+			}
+			return
+		}
+	}
+
 	acceptConnection(u)
 }
 
@@ -573,12 +914,28 @@ func acceptHTTPConnection(conn net.Conn) {
 		conn.Close()
 		fmt.Printf("[acceptConnection] User Creation error: %s", err.Error())
 	}
-	u.Socket = conn
-	u.SocketType = SocketTypeNetwork
+	client := newTelnetConn(conn)
+
+	//on the tls port the first write does the handshake, which a client
+	//could otherwise leave hanging for good
+	conn.SetDeadline(time.Now().Add(handshakeTime()))
+	if err = client.Write(client.telnet.negotiate()); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	u.Conn = newOutputQueue(client)
 	acceptConnection(u)
 }
 
 func acceptConnection(u *User) {
+	if banList.SiteBanned(u.site()) {
+		u.Write("\n\rLogins from your site/domain are banned.\n\n\r")
+		u.Close()
+		return
+	}
+
 	var motd1Count int
 	talkerSystem.Lock()
 	motd1Count = talkerSystem.Motd1Count
@@ -596,28 +953,35 @@ func acceptConnection(u *User) {
 		u.Write("Welcome to here!\n\nSorry, but the login screen sppears to be missing at this time.\n\r")
 	}
 
-	if talkerConfig.StopLogins {
-		u.Write("\n\rSorry, but no connections can be made at the moment.\n\rPlease try later\n\n\r")
-		u.Disconnect()
-		userList.RemoveUser(u)
+	if !canConnect(u) {
 		return
 	}
 
 	talkerSystem.Lock()
-	OnlineUsers := talkerSystem.OnlineCount + talkerSystem.LoginCount
+	talkerSystem.LoginCount++
 	talkerSystem.Unlock()
+	handleUser(u)
+}
 
-	if OnlineUsers >= talkerConfig.MaxUsers {
-		u.Write("\n\rSorry, but we cannot accept any more connections at this moment.\n\rPlease try again later\n\n\r")
-		u.Disconnect()
-		userList.RemoveUser(u)
-		return
+// canConnect turns the connection away if logins are stopped or the talker
+// is full.
+func canConnect(u *User) bool {
+	if getConfig().StopLogins {
+		u.Write("\n\rSorry, but no connections can be made at the moment.\n\rPlease try later\n\n\r")
+		u.Close()
+		return false
 	}
 
 	talkerSystem.Lock()
-	talkerSystem.LoginCount++
+	OnlineUsers := talkerSystem.OnlineCount + talkerSystem.LoginCount
 	talkerSystem.Unlock()
-	handleUser(u)
+
+	if OnlineUsers >= getConfig().MaxUsers {
+		u.Write("\n\rSorry, but we cannot accept any more connections at this moment.\n\rPlease try again later\n\n\r")
+		u.Close()
+		return false
+	}
+	return true
 }
 
 func connectUser(u *User) {
@@ -631,51 +995,41 @@ func connectUser(u *User) {
 	u.Lock()
 	name = u.Recap
 	desc = u.Description
+	u.Room = mainRoom
 	u.Unlock()
 
-	writeWorld(userList, fmt.Sprintf("~OL[Entering is: ~RS%s~RS %s~RS~OL]\n", name, desc))
+	writeWorld(&userList, u, fmt.Sprintf("~OL[Entering is: ~RS%s~RS %s~RS~OL]\n", name, desc))
+	notifyFriends(u, true)
+	sendWhoUpdate()
+	look(u)
 }
 
 func handleUser(u *User) {
-	buffer := make([]byte, 2048)
 	u.Lock()
 	u.LastInput = time.Now()
 	u.Unlock()
 	login(u, "")
+	go loginTimeout(u)
+	readInput(u)
+}
 
-	//since this is the main loop go won't clean this up. should this be moved some where else?
-	logimTimeDuration := int64(time.Minute) * int64(talkerConfig.LoginIdleTime)
-	loginTimer := time.NewTimer(time.Duration(logimTimeDuration))
-	go func() {
-		<-loginTimer.C
-		u.Lock()
-		since := time.Since(u.LastInput)
-		loginStage := u.Login
-		u.Unlock()
-		if u != nil && loginStage == LoginName && int(since.Minutes()) >= talkerConfig.LoginIdleTime {
-			u.Write("\n\n*** Time out ***\n\n")
-			u.Disconnect()
-			userList.RemoveUser(u)
-		}
-	}()
-
+// readInput is the main loop for a connection, reading lines until the user
+// leaves or the connection drops.
+func readInput(u *User) {
 	for {
-		var n int
-		var err error
-		var text string
-
-		if u.SocketType == SocketTypeWebSocket {
-			err = websocket.Message.Receive(u.WebSocket, &text)
-			text = strings.TrimSpace(text)
-			n = len(text)
-		} else {
-			n, err = u.Socket.Read(buffer)
-			text = strings.TrimSpace(string(buffer[:n]))
+		line, err := u.Conn.ReadLine()
+		if talkerStopping() {
+			//the connection is being closed for us, or belongs to the new
+			//process after a hot reboot
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err == errLineTooLong {
+			u.Write(fmt.Sprintf("\nLine too long, input over %d characters is ignored.\n", maxLineLen))
+			continue
 		}
-		u.Lock()
-		u.LastInput = time.Now()
-		u.Unlock()
-
 		if err != nil {
 			fmt.Printf("failed to read from connection. disconnecting them. %s\n", err)
 			u.Disconnect()
@@ -683,119 +1037,258 @@ func handleUser(u *User) {
 			break
 		}
 
-		fmt.Printf("client Input: '%s'\n", text)
-		if u.Login > 0 {
-			login(u, text)
-		} else {
-			var possibleCommand string
+		u.active()
+		if handleInput(u, strings.TrimSpace(line)) {
+			break
+		}
+	}
+}
 
-			if len(text) > 0 && text[0] == '.' {
-				firstWhiteSpace := strings.Index(text, " ")
+// handleInput deals with a single line of input. it returns true once the
+// user has been disconnected.
+func handleInput(u *User, text string) bool {
+	u.Lock()
+	loginStage := u.Login
+	u.Unlock()
 
-				if firstWhiteSpace != -1 {
-					possibleCommand = text[1:firstWhiteSpace]
-					firstWhiteSpace++
-				} else {
-					possibleCommand = text[1:]
-					firstWhiteSpace = len(text)
-				}
-				text = text[firstWhiteSpace:]
-			} else {
-				possibleCommand = defaultCommand
-			}
+	if loginStage != LoginLogged {
+		if loginStage != LoginPasswd && loginStage != LoginConfirm {
+			fmt.Printf("client Input: '%s'\n", text)
+		}
+		return login(u, text)
+	}
 
-			if val, ok := commands[possibleCommand]; ok {
-				exitLoop := val(u, text)
-				if exitLoop == true {
-					break
-				}
-			} else {
-				u.Write("unknown command\n")
-			}
+	fmt.Printf("client Input: '%s'\n", text)
+	if u.pagerInput(text) {
+		return false
+	}
+
+	var possibleCommand string
+
+	if len(text) > 0 && text[0] == '.' {
+		firstWhiteSpace := strings.Index(text, " ")
+
+		if firstWhiteSpace != -1 {
+			possibleCommand = text[1:firstWhiteSpace]
+			firstWhiteSpace++
+		} else {
+			possibleCommand = text[1:]
+			firstWhiteSpace = len(text)
 		}
+		text = text[firstWhiteSpace:]
+	} else {
+		possibleCommand = defaultCommand
+	}
 
-		for i := 0; i < n; i++ {
-			//resetting input buffer
-			buffer[i] = 0x00
+	if u.canUse(possibleCommand) {
+		return commands[possibleCommand].fn(u, text)
+	}
+
+	u.Write("unknown command\n")
+	return false
+}
+
+// helpColumns lays command names out in sorted columns.
+func helpColumns(names []string, columns int) string {
+	sort.Strings(names)
+
+	var output string
+	count := 0
+	for _, key := range names {
+		count++
+		output += fmt.Sprintf("%11s", key)
+
+		if count%columns == 0 {
+			output += "\n"
 		}
 	}
+	if count%columns != 0 {
+		output += "\n"
+	}
+	return output
 }
 
-func writeWorld(ulist []*User, buffer string) {
-	for _, u := range ulist {
-		u.Write(buffer)
+// writeWorld writes to everyone online. anything sent by a user is treated
+// as a shout and skips those ignoring them, a nil sender is the system.
+func writeWorld(ulist *users, sender *User, buffer string) {
+	var name string
+	if sender != nil {
+		sender.Lock()
+		name = sender.Name
+		sender.Unlock()
+	}
+	for _, u := range ulist.online() {
+		if !u.ignores(name, ignoreShouts) {
+			u.Write(buffer)
+		}
 	}
 }
 
-func login(u *User, inpstr string) {
+// login runs the login state machine for a single line of input. it returns
+// true when the user has been disconnected.
+func login(u *User, inpstr string) bool {
 	switch u.Login {
 	case LoginName:
 		if inpstr == "" {
-			u.Write("\nGive me a name:")
-			return
-		}
-		if len(inpstr) < userNameMin {
-			u.Write("\nName too short.\n\n")
-			return
+			u.Prompt("\nGive me a name: ", false)
+			return false
 		}
-		if len(inpstr) > userNameLenMax {
-			u.Write("\nName too long.\n\n")
-			return
+		if err := validName(inpstr); err != nil {
+			u.Write(fmt.Sprintf("\n%s\n\n", err.Error()))
+			return false
 		}
 
-		//check password..
-		_, err := os.Stat(userFiles + u.Name + ".json")
+		if banList.UserBanned(inpstr) {
+			u.Write("\nYou are banned from this talker.\n\n")
+			u.Disconnect()
+			return true
+		}
 
-		if err != nil && os.IsNotExist(err) {
+		exists, err := userStore.Exists(inpstr)
+		if err == nil && !exists {
 			u.Write("new user...\n")
 			u.Lock()
-			u.Name = inpstr
-			u.Recap = inpstr
-			u.Login = LoginConfirm
+			u.Level = newUserLevel()
 			u.Unlock()
-		} else {
-			u.Lock()
-			u.Name = inpstr
+		} else if err == nil {
+			err = u.Load(inpstr)
+		}
+
+		if err == errUserQuarantined {
+			u.Write("\nYour account has been damaged and set aside, please contact the staff.\n\n")
+			u.Disconnect()
+			return true
+		}
+		if err != nil {
+			fmt.Printf("unable to load user file for '%s': %s\n", inpstr, err.Error())
+			u.Write(fmt.Sprintf("\n%s: unable to load your account.\n\n", syserror))
+			u.Disconnect()
+			return true
+		}
+
+		//accounts from before passwords would go to whoever typed the name first
+		u.Lock()
+		unclaimed := exists && u.Password == ""
+		u.Unlock()
+		if unclaimed && !getConfig().ClaimAccounts {
+			fmt.Printf("refused login to '%s', the account has no password\n", inpstr)
+			u.Write("\nThis account has no password set, please contact the staff.\n\n")
+			u.Disconnect()
+			return true
+		}
+
+		u.Lock()
+		u.Name = inpstr
+		if u.Recap == "" {
 			u.Recap = inpstr
-			u.Login = LoginPasswd
-			u.Unlock()
 		}
+		u.Login = LoginPasswd
+		u.Unlock()
 
-		u.Write("\nPassword:")
-		return
+		u.Prompt("\nPassword: ", true)
+		u.echoOff()
+		return false
 	case LoginPasswd:
-		//check password
+		if inpstr == "" {
+			u.Prompt("\nPassword: ", true)
+			return false
+		}
+
+		u.Lock()
+		hash := u.Password
+		u.Unlock()
+
+		//no stored password means a new account, or one from before passwords
+		//when claim_passwordless_accounts allows it
+		if hash == "" {
+			if len(inpstr) < userPasswdMin {
+				u.Prompt("\n\nPassword too short.\n\nPassword: ", true)
+				return false
+			}
+
+			newHash, err := bcrypt.GenerateFromPassword([]byte(inpstr), bcrypt.DefaultCost)
+			if err != nil {
+				fmt.Printf("unable to hash password: %s\n", err.Error())
+				u.Write(fmt.Sprintf("\n%s\n\n", syserror))
+				u.Disconnect()
+				return true
+			}
+
+			u.Lock()
+			u.Password = string(newHash)
+			u.Login = LoginConfirm
+			u.Unlock()
+			u.Prompt("\nPlease confirm password: ", true)
+			return false
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(inpstr)) != nil {
+			return u.failedLogin("Incorrect login.")
+		}
+
+		u.echoOn()
 		u.Lock()
 		u.Login = LoginPrompt
 		u.Unlock()
-		return
+		u.Prompt("\n\nPress return to continue: \n\n", false)
+		return false
 	case LoginConfirm:
 		u.Lock()
-		u.Description = "is a newbie."
-		u.SaveToFile(userFiles + u.Name + ".json")
+		hash := u.Password
+		u.Unlock()
+
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(inpstr)) != nil {
+			u.Lock()
+			u.Password = ""
+			u.Login = LoginPasswd
+			u.Unlock()
+			return u.failedLogin("Passwords do not match.")
+		}
+
+		u.echoOn()
+		u.Lock()
+		if u.Description == "" {
+			u.Description = "is a newbie."
+		}
 		u.Login = LoginPrompt
 		u.Unlock()
-		u.Write("\n\nPress return to continue: \n\n")
-		return
-	case LoginPrompt:
-		var motd2Count int
-		talkerSystem.Lock()
-		motd2Count = talkerSystem.Motd2Count
-		talkerSystem.Unlock()
 
-		if motd2Count > 0 {
-			contents, err := ioutil.ReadFile(motdFiles + "/motd2/motd" + strconv.Itoa(rand.Intn(motd2Count)) + ".tmpl")
-			if err != nil {
-				fmt.Printf("problem with motd2: %s\n", err.Error())
-			} else {
-				u.Write("\n" + string(contents))
-			}
+		err := u.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", u.Name, err.Error())
+		}
+		u.Prompt("\n\nPress return to continue: \n\n", false)
+		return false
+	case LoginColor:
+		switch strings.ToLower(inpstr) {
+		case "y", "yes":
+			inpstr = "on"
+		case "n", "no":
+			inpstr = "off"
+		default:
+			u.Prompt("\nPlease answer y or n: ", false)
+			return false
+		}
 
-		} else {
-			u.Write("Welcome to here!\n\nSorry, but the post login screen sppears to be missing at this time.\n\r")
+		u.Lock()
+		u.Color = inpstr
+		u.Unlock()
+		u.saveAttributes()
+		if u.canUse("set") {
+			u.Write("\nYou can change this at any time with 'set colour'.\n")
+		}
+		fallthrough
+	case LoginPrompt:
+		if u.asksColor() {
+			u.Lock()
+			u.Login = LoginColor
+			u.Unlock()
+			u.Prompt(colorQuestion, false)
+			return false
 		}
 
-		u.Write("\n\nPress return to continue: \n\n")
+		loginNotices(u)
+		u.Prompt("\n\nPress return to continue: \n\n", false)
 
 		u.Lock()
 		u.Login = LoginLogged
@@ -803,11 +1296,108 @@ func login(u *User, inpstr string) {
 		u.Write("\n\n")
 		userList.AddUser(u)
 		connectUser(u)
-		return
+		return false
+	}
+
+	return false
+}
+
+// validName checks a name is one that could be given to a new account.
+func validName(name string) error {
+	if len(name) < userNameMin {
+		return errors.New("Name too short.")
+	}
+	if len(name) > userNameLenMax {
+		return errors.New("Name too long.")
+	}
+	for _, char := range name {
+		if (char < 'a' || char > 'z') && (char < 'A' || char > 'Z') {
+			return errors.New("Only letters are allowed in a name.")
+		}
+	}
+	return nil
+}
+
+// indexName finds name in a list of names in any case, or -1 if it isn't
+// there.
+func indexName(names []string, name string) int {
+	for i, current := range names {
+		if strings.EqualFold(current, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsName(names []string, name string) bool {
+	return indexName(names, name) != -1
+}
+
+func removeName(names []string, name string) []string {
+	if i := indexName(names, name); i != -1 {
+		return append(names[:i], names[i+1:]...)
+	}
+	return names
+}
+
+// colorQuestion is asked at login of clients that give no hint about colour.
+const colorQuestion = "\n~OL~FRDo ~FGyou ~FYsee ~FBcolour~RS? (y/n): "
+
+// loginNotices shows the post-login motd and anything waiting for the user.
+func loginNotices(u *User) {
+	var motd2Count int
+	talkerSystem.Lock()
+	motd2Count = talkerSystem.Motd2Count
+	talkerSystem.Unlock()
+
+	if motd2Count > 0 {
+		contents, err := ioutil.ReadFile(motdFiles + "/motd2/motd" + strconv.Itoa(rand.Intn(motd2Count)) + ".tmpl")
+		if err != nil {
+			fmt.Printf("problem with motd2: %s\n", err.Error())
+		} else {
+			u.Write("\n" + string(contents))
+		}
+
+	} else {
+		u.Write("Welcome to here!\n\nSorry, but the post login screen sppears to be missing at this time.\n\r")
+	}
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+	if unread := unreadMail(name); unread > 0 {
+		u.Write(fmt.Sprintf("\n~FT~OL*** YOU HAVE %d UNREAD MAIL MESSAGE(S) ***\n", unread))
+	}
+	if unread := unreadBoards(u); unread != "" {
+		u.Write("\n" + unread)
+	}
+}
+
+// failedLogin counts a bad password and drops the connection once the
+// configured number of attempts has been used up.
+func (u *User) failedLogin(reason string) bool {
+	maxAttempts := getConfig().LoginAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = loginAttempts
+	}
+
+	u.Lock()
+	u.attempts++
+	attempts := u.attempts
+	u.Unlock()
+
+	if attempts >= maxAttempts {
+		u.Write("\n\nMaximum attempts reached.\n\n")
+		u.echoOn()
+		u.Disconnect()
+		return true
 	}
+
+	u.Prompt(fmt.Sprintf("\n\n%s\n\nPassword: ", reason), true)
+	return false
 }
 
-func loadCommandTemplates(comDirectory string) {
+func loadCommandTemplates(comDirectory string) error {
 	templateFuncs := template.FuncMap{
 		"colorCount": func(format string, addTo int) int {
 			return countColors(format) + addTo
@@ -815,33 +1405,41 @@ func loadCommandTemplates(comDirectory string) {
 		"join": func(joinString string, s ...string) string {
 			return strings.Join(s, joinString)
 		},
+		"repeat": func(s string, count int) string {
+			if count < 0 {
+				return ""
+			}
+			return strings.Repeat(s, count)
+		},
 	}
 
 	files, err := ioutil.ReadDir(comDirectory)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("unable to load command templates: (%s) %s", comDirectory, err.Error()))
+		return fmt.Errorf("unable to load command templates: (%s) %s", comDirectory, err.Error())
 	}
 
-	commandTemplates = make(map[string]*template.Template)
+	templates := make(map[string]*template.Template)
 	for _, file := range files {
 		ext := path.Ext(file.Name())
 		commandName := file.Name()[:len(file.Name())-len(ext)]
 		if _, ok := commands[commandName]; ok {
-			commandTemplates[commandName], err = template.New(file.Name()).Funcs(templateFuncs).ParseFiles(comDirectory + "/" + file.Name())
+			templates[commandName], err = template.New(file.Name()).Funcs(templateFuncs).ParseFiles(comDirectory + "/" + file.Name())
 
 			if err != nil {
-				log.Fatal(fmt.Sprintf("unable to prase command template: %s", err))
+				return fmt.Errorf("unable to prase command template: %s", err)
 			}
 		}
 	}
+
+	reloadLock.Lock()
+	commandTemplates = templates
+	reloadLock.Unlock()
+	return nil
 }
 
+// countMotds counts the motds on disk. the counts are only replaced once
+// both directories have been read, so a failed reload keeps the old ones.
 func countMotds(motdDir string) error {
-	talkerSystem.Lock()
-	talkerSystem.Motd1Count = 0
-	talkerSystem.Motd2Count = 0
-	talkerSystem.Unlock()
-
 	files, err := ioutil.ReadDir(motdDir + "/motd1")
 
 	if err != nil {
@@ -861,56 +1459,3 @@ func countMotds(motdDir string) error {
 
 	return nil
 }
-
-func countColors(colorString string) int {
-	colorCount := 0
-	wait := 0
-	for index, char := range colorString {
-		if wait > 0 {
-			wait--
-			continue
-		}
-		if char == '^' && len(colorString) < index+1 && colorString[index+1] == '~' {
-			wait = 1
-			continue
-		} else if char == '~' {
-			colorFind := colorString[index+1 : index+3]
-			for i := 0; i < len(colorCodesList); i++ {
-				if colorFind == colorCodesList[i].TextCode {
-					colorCount += 1 + len(colorCodesList[i].TextCode)
-					wait = len(colorCodesList[i].TextCode)
-					break
-				}
-			}
-		}
-	}
-
-	return colorCount
-}
-
-func colorComStrip(str string) string {
-	removedColor := ""
-	wait := 0
-	foundColor := false
-	for index, char := range str {
-		if wait > 0 {
-			wait--
-			foundColor = false
-			continue
-		}
-		if char == '~' && (index == 0 || index > 0 && str[index-1] != '^') {
-			colorFind := str[index+1 : index+3]
-			for i := 0; i < len(colorCodesList); i++ {
-				if colorFind == colorCodesList[i].TextCode {
-					wait = len(colorCodesList[i].TextCode)
-					foundColor = true
-					break
-				}
-			}
-		}
-		if foundColor == false {
-			removedColor += string(char)
-		}
-	}
-	return removedColor
-}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// how many tells each user keeps for .revtell
+const revtellLines = 20
+
+type messageHistory struct {
+	User    string    `json:"user"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// historyBuffer is a ring buffer keeping the most recent messages. it is
+// saved as a plain list, oldest first. the zero value holds revtellLines
+// messages, whoever owns it guards it with their own lock.
+type historyBuffer struct {
+	entries []*messageHistory
+	start   int
+	limit   int
+}
+
+func (b *historyBuffer) capacity() int {
+	if b.limit <= 0 {
+		return revtellLines
+	}
+	return b.limit
+}
+
+func (b *historyBuffer) add(entry *messageHistory) {
+	if len(b.entries) < b.capacity() {
+		b.entries = append(b.entries, entry)
+		return
+	}
+	b.entries[b.start] = entry
+	b.start = (b.start + 1) % len(b.entries)
+}
+
+// list returns the messages in the order they were added.
+func (b *historyBuffer) list() []*messageHistory {
+	ordered := make([]*messageHistory, 0, len(b.entries))
+	ordered = append(ordered, b.entries[b.start:]...)
+	return append(ordered, b.entries[:b.start]...)
+}
+
+func (b *historyBuffer) clear() {
+	b.entries = nil
+	b.start = 0
+}
+
+func (b historyBuffer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.list())
+}
+
+// UnmarshalJSON keeps only the newest messages that fit, and skips the empty
+// entries older user files were saved with.
+func (b *historyBuffer) UnmarshalJSON(data []byte) error {
+	var saved []*messageHistory
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	b.clear()
+	for _, entry := range saved {
+		if entry != nil && entry.Message != "" {
+			b.add(entry)
+		}
+	}
+	return nil
+}
+
+// location is the user's timezone, or the talker's own if they haven't set
+// one.
+func (u *User) location() *time.Location {
+	u.Lock()
+	timezone := u.Timezone
+	u.Unlock()
+
+	if timezone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Local
+	}
+	return location
+}
+
+func cmdRevtell(u *User, inpstr string) bool {
+	if inpstr == "clear" {
+		u.Lock()
+		u.PastTells.clear()
+		u.Unlock()
+		u.saveAttributes()
+		u.Write("Revtell buffer cleared.\n")
+		return false
+	}
+
+	location := u.location()
+	u.Lock()
+	tells := u.PastTells.list()
+	u.Unlock()
+
+	var tellHistory string
+	for _, tellMessage := range tells {
+		if inpstr != "" && !strings.EqualFold(tellMessage.User, inpstr) {
+			continue
+		}
+		tellHistory += fmt.Sprintf("~OL[%s]~RS %s", tellMessage.Time.In(location).Format("Jan 02 15:04"), tellMessage.Message)
+	}
+
+	output := "\n~BB~FG*** Your Tell buffer ***\n\n"
+	if inpstr != "" {
+		output = fmt.Sprintf("\n~BB~FG*** Your Tell buffer with %s ***\n\n", inpstr)
+	}
+	if tellHistory == "" {
+		u.Write(output + "Revtell buffer is empty.\n")
+		return false
+	}
+	u.Page(output + tellHistory + "\n~BB~FG*** End ***\n\n")
+	return false
+}
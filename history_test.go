@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// historyMessages lists what is in the buffer, oldest first.
+func historyMessages(b *historyBuffer) []string {
+	var messages []string
+	for _, entry := range b.list() {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+// numbered is the messages first to last-1, as strings.
+func numbered(first, last int) []string {
+	var messages []string
+	for i := first; i < last; i++ {
+		messages = append(messages, strconv.Itoa(i))
+	}
+	return messages
+}
+
+func TestHistoryBufferWrap(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		added int
+		want  []string
+	}{
+		{"empty", 3, 0, nil},
+		{"part full", 3, 2, numbered(0, 2)},
+		{"full", 3, 3, numbered(0, 3)},
+		{"wrapped once", 3, 4, numbered(1, 4)},
+		{"wrapped to the start", 3, 6, numbered(3, 6)},
+		{"wrapped many times", 3, 17, numbered(14, 17)},
+		{"one entry", 1, 5, numbered(4, 5)},
+		{"default limit", 0, revtellLines + 5, numbered(5, revtellLines+5)},
+	}
+
+	for _, test := range tests {
+		b := historyBuffer{limit: test.limit}
+		for i := 0; i < test.added; i++ {
+			b.add(&messageHistory{Message: strconv.Itoa(i)})
+		}
+		if got := historyMessages(&b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHistoryBufferJSON(t *testing.T) {
+	//a wrapped buffer is saved oldest first and loads back the same way
+	saved := historyBuffer{limit: 3}
+	for i := 0; i < 5; i++ {
+		saved.add(&messageHistory{Message: strconv.Itoa(i)})
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := historyBuffer{limit: 3}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := historyMessages(&loaded); !reflect.DeepEqual(got, numbered(2, 5)) {
+		t.Errorf("round trip: got %q, want %q", got, numbered(2, 5))
+	}
+
+	//too many saved messages keeps the newest, empty ones are skipped
+	loaded = historyBuffer{limit: 2}
+	err = json.Unmarshal([]byte(`[{"message":"0"},{"message":""},null,{"message":"1"},{"message":"2"}]`), &loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := historyMessages(&loaded); !reflect.DeepEqual(got, numbered(1, 3)) {
+		t.Errorf("old file: got %q, want %q", got, numbered(1, 3))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	idleSweepInterval = 30 * time.Second
+	afkMessageLen     = 60
+)
+
+// idleLimits works out when users are warned and when they are removed, in
+// that order. a zero timeout means idle users are never removed.
+func idleLimits() (warn time.Duration, timeout time.Duration) {
+	cfg := getConfig()
+	timeout = time.Duration(cfg.UserIdleTime) * time.Minute
+	warn = time.Duration(cfg.IdleWarnTime) * time.Minute
+	if warn <= 0 || warn >= timeout {
+		warn = timeout * 3 / 4
+	}
+	return warn, timeout
+}
+
+// idleExemptLevel is the lowest level that is never timed out.
+func idleExemptLevel() int {
+	if level := indexName(levelNames, getConfig().IdleExempt); level != -1 {
+		return level
+	}
+	return LevelWiz
+}
+
+// idleSweeper warns and then removes anyone who hasn't typed anything for
+// too long.
+func idleSweeper() {
+	for range time.Tick(idleSweepInterval) {
+		warn, timeout := idleLimits()
+		if timeout <= 0 {
+			continue
+		}
+		exempt := idleExemptLevel()
+
+		online := userList.online()
+
+		for _, u := range online {
+			u.Lock()
+			idle := time.Since(u.LastInput)
+			level := u.Level
+			warned := u.idleWarned
+			if idle >= warn {
+				u.idleWarned = true
+			}
+			u.Unlock()
+
+			if level >= exempt {
+				continue
+			}
+
+			if idle >= timeout {
+				u.Write("\n\n*** Time out ***\n\n")
+				u.Disconnect()
+				userList.RemoveUser(u)
+			} else if idle >= warn && !warned {
+				left := (timeout - idle).Round(time.Second)
+				u.Write(fmt.Sprintf("\n~FY~OL*** You have been idle for %s, you will be disconnected in %s unless you type something ***\n\n", idle.Round(time.Second), left))
+			}
+		}
+	}
+}
+
+// handshakeTime is how long a new connection gets to finish a tls or ssh
+// handshake, before it reaches the login prompt and loginTimeout.
+func handshakeTime() time.Duration {
+	limit := time.Duration(getConfig().LoginIdleTime) * time.Minute
+	if limit <= 0 {
+		limit = time.Minute
+	}
+	return limit
+}
+
+// loginTimeout drops connections that stay at any login stage for longer
+// than login_idle_time.
+func loginTimeout(u *User) {
+	limit := time.Duration(getConfig().LoginIdleTime) * time.Minute
+	if limit <= 0 {
+		return
+	}
+	for {
+		u.Lock()
+		since := time.Since(u.LastInput)
+		loginStage := u.Login
+		gone := u.disconnected
+		u.Unlock()
+
+		if gone || loginStage == LoginLogged {
+			return
+		}
+		if since >= limit {
+			u.Write("\n\n*** Time out ***\n\n")
+			u.echoOn()
+			u.Disconnect()
+			return
+		}
+		time.Sleep(limit - since)
+	}
+}
+
+// active is called whenever the user types something, bringing them back
+// from being idle or away.
+func (u *User) active() {
+	u.Lock()
+	u.LastInput = time.Now()
+	u.idleWarned = false
+	wasAFK := u.afk
+	u.afk = false
+	u.afkMessage = ""
+	name := u.Recap
+	room := u.Room
+	u.Unlock()
+
+	if wasAFK {
+		u.Write("You are no longer AFK.\n")
+		writeRoomExcept(&userList, room, u, fmt.Sprintf("%s~RS comes back from being AFK.\n", name))
+	}
+}
+
+// idleStatus is how the user's activity is shown on the who list.
+func (u *User) idleStatus() string {
+	warn, _ := idleLimits()
+	u.Lock()
+	defer u.Unlock()
+	if u.afk {
+		return "AFK"
+	}
+	if warn > 0 && time.Since(u.LastInput) >= warn {
+		return "idle"
+	}
+	return ""
+}
+
+func cmdAfk(u *User, inpstr string) bool {
+	if len(inpstr) > afkMessageLen {
+		u.Write("AFK message too long.\n")
+		return false
+	}
+
+	u.Lock()
+	u.afk = true
+	u.afkMessage = inpstr
+	name := u.Recap
+	room := u.Room
+	u.Unlock()
+
+	if inpstr == "" {
+		u.Write("You are now AFK, type anything to come back.\n")
+		writeRoomExcept(&userList, room, u, fmt.Sprintf("%s~RS goes AFK.\n", name))
+	} else {
+		u.Write(fmt.Sprintf("You are now AFK with the message: %s\n", inpstr))
+		writeRoomExcept(&userList, room, u, fmt.Sprintf("%s~RS goes AFK: %s\n", name, inpstr))
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// users can ignore particular people, or everyone's tells, shouts or
+// everything at once. messages from the system itself always get through.
+const ignoreMax = 50
+
+type ignoreKind int
+
+type ignoreList struct {
+	Users  []string `json:"users"`
+	Tells  bool     `json:"tells"`
+	Shouts bool     `json:"shouts"`
+	All    bool     `json:"all"`
+}
+
+const (
+	ignoreTells ignoreKind = iota
+	ignoreShouts
+	ignoreSpeech
+)
+
+// ignores reports whether u has asked not to see this kind of message from
+// the named user.
+func (u *User) ignores(sender string, kind ignoreKind) bool {
+	if sender == "" {
+		return false
+	}
+
+	u.Lock()
+	defer u.Unlock()
+	if strings.EqualFold(sender, u.Name) {
+		return false
+	}
+	if u.Ignore.All {
+		return true
+	}
+	if kind == ignoreTells && u.Ignore.Tells || kind == ignoreShouts && u.Ignore.Shouts {
+		return true
+	}
+	return containsName(u.Ignore.Users, sender)
+}
+
+// toggleIgnore switches ignoring tells, shouts or everything on and off.
+func toggleIgnore(u *User, what string) {
+	u.Lock()
+	setting := &u.Ignore.All
+	switch what {
+	case "tells":
+		setting = &u.Ignore.Tells
+	case "shouts":
+		setting = &u.Ignore.Shouts
+	case "all":
+		what = "everyone"
+	}
+	*setting = !*setting
+	on := *setting
+	u.Unlock()
+	u.saveAttributes()
+
+	if on {
+		u.Write(fmt.Sprintf("You are now ignoring %s.\n", what))
+	} else {
+		u.Write(fmt.Sprintf("You are no longer ignoring %s.\n", what))
+	}
+}
+
+// cmdIgnore takes a user, or -tells, -shouts or -all. names are only ever
+// letters, so the dash keeps the switches apart from anyone called Tells.
+func cmdIgnore(u *User, inpstr string) bool {
+	switch strings.ToLower(inpstr) {
+	case "-tells", "-shouts", "-all":
+		toggleIgnore(u, strings.ToLower(inpstr[1:]))
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+
+	if inpstr == "" || strings.Contains(inpstr, " ") {
+		u.Write("Usage: ignore <user>|-tells|-shouts|-all\n")
+		return false
+	}
+	if strings.EqualFold(inpstr, name) {
+		u.Write("You cannot ignore yourself.\n")
+		return false
+	}
+
+	u.Lock()
+	if i := indexName(u.Ignore.Users, inpstr); i != -1 {
+		ignored := u.Ignore.Users[i]
+		u.Ignore.Users = removeName(u.Ignore.Users, inpstr)
+		u.Unlock()
+		u.saveAttributes()
+		u.Write(fmt.Sprintf("You are no longer ignoring %s.\n", ignored))
+		return false
+	}
+	total := len(u.Ignore.Users)
+	u.Unlock()
+
+	if total >= ignoreMax {
+		u.Write(fmt.Sprintf("You can only ignore %d people.\n", ignoreMax))
+		return false
+	}
+
+	target, exists := resolveAccountName(inpstr)
+	if !exists {
+		u.Write("There is no one of that name.\n")
+		return false
+	}
+
+	u.Lock()
+	u.Ignore.Users = append(u.Ignore.Users, target)
+	u.Unlock()
+	u.saveAttributes()
+	u.Write(fmt.Sprintf("You are now ignoring %s.\n", target))
+	return false
+}
+
+func cmdListIgnore(u *User, inpstr string) bool {
+	u.Lock()
+	ignoring := make([]string, len(u.Ignore.Users))
+	copy(ignoring, u.Ignore.Users)
+	tells, shouts, all := u.Ignore.Tells, u.Ignore.Shouts, u.Ignore.All
+	u.Unlock()
+
+	yesNo := func(on bool) string {
+		if on {
+			return "~FRyes~RS"
+		}
+		return "no"
+	}
+
+	output := "\n~BB~FG*** You are ignoring ***\n\n"
+	output += fmt.Sprintf("Tells      : %s\n", yesNo(tells))
+	output += fmt.Sprintf("Shouts     : %s\n", yesNo(shouts))
+	output += fmt.Sprintf("Everything : %s\n\n", yesNo(all))
+	if len(ignoring) == 0 {
+		output += "You are not ignoring anyone.\n"
+	} else {
+		output += helpColumns(ignoring, (u.Width()-1)/11)
+	}
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+	return false
+}
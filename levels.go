@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	LevelNew = iota
+	LevelUser
+	LevelWiz
+	LevelArch
+	LevelGod
+)
+
+const auditLog = "logfiles/audit.log"
+
+var levelNames = []string{"NEW", "USER", "WIZ", "ARCH", "GOD"}
+
+type command struct {
+	level int
+	fn    func(*User, string) bool
+}
+
+func levelName(level int) string {
+	if level < 0 || level >= len(levelNames) {
+		return "UNKNOWN"
+	}
+	return levelNames[level]
+}
+
+// canUse reports whether the named command exists and u's level allows it.
+func (u *User) canUse(name string) bool {
+	cmd, ok := commands[name]
+	if !ok {
+		return false
+	}
+	u.Lock()
+	defer u.Unlock()
+	return u.Level >= cmd.level
+}
+
+// levelByName finds a level from its name, in any case.
+func levelByName(name string) (int, error) {
+	if level := indexName(levelNames, name); level != -1 {
+		return level, nil
+	}
+	return 0, fmt.Errorf("unknown level '%s', use one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// newUserLevel is the level new accounts start at. it defaults to USER and
+// can only be set as high as that, staff have to be promoted.
+func newUserLevel() int {
+	name := getConfig().NewUserLevel
+	if name == "" {
+		return LevelUser
+	}
+	level, err := levelByName(name)
+	if err != nil || level > LevelUser {
+		fmt.Printf("new_user_level '%s' is not NEW or USER, using USER\n", name)
+		return LevelUser
+	}
+	return level
+}
+
+// writeAudit appends a timestamped line to the audit log.
+func writeAudit(format string, a ...interface{}) {
+	line := fmt.Sprintf("%s: %s\n", time.Now().Format(time.ANSIC), fmt.Sprintf(format, a...))
+	fmt.Print(line)
+
+	err := os.MkdirAll(path.Dir(auditLog), 0700)
+	if err != nil {
+		fmt.Printf("unable to create audit log directory: %s\n", err.Error())
+		return
+	}
+
+	f, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Printf("unable to open audit log: %s\n", err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(line); err != nil {
+		fmt.Printf("unable to write audit log: %s\n", err.Error())
+	}
+}
+
+// changeLevel moves the named user up or down a single level. users that are
+// not logged on have their user file updated instead.
+func changeLevel(u *User, inpstr string, change int) {
+	var verb string
+	if change > 0 {
+		verb = "promote"
+	} else {
+		verb = "demote"
+	}
+
+	name := strings.TrimSpace(inpstr)
+	if name == "" {
+		u.Write(fmt.Sprintf("Usage: %s <user>\n", verb))
+		return
+	}
+
+	u.Lock()
+	myName := u.Name
+	myLevel := u.Level
+	u.Unlock()
+
+	if name == myName {
+		u.Write(fmt.Sprintf("You cannot %s yourself.\n", verb))
+		return
+	}
+
+	online := true
+	target, err := userList.FindByUserName(name)
+	if err != nil {
+		online = false
+		target, err = LoadUser(name)
+		if err != nil {
+			u.Write("There is no such user.\n")
+			return
+		}
+	}
+
+	target.Lock()
+	oldLevel := target.Level
+	newLevel := oldLevel + change
+	if change > 0 && newLevel >= myLevel {
+		target.Unlock()
+		u.Write("You cannot promote a user to a level equal to or higher than your own.\n")
+		return
+	}
+	if change < 0 && oldLevel >= myLevel {
+		target.Unlock()
+		u.Write("You cannot demote a user of an equal or higher level than yourself.\n")
+		return
+	}
+	if newLevel < LevelNew {
+		target.Unlock()
+		u.Write("You cannot demote a user below the lowest level.\n")
+		return
+	}
+	target.Level = newLevel
+	recap := target.Recap
+	target.Unlock()
+
+	if !online {
+		err = target.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", name, err.Error())
+			u.Write(syserror + "\n")
+			return
+		}
+	}
+
+	writeAudit("%s %sd %s from %s to %s", myName, verb, name, levelName(oldLevel), levelName(newLevel))
+	u.Write(fmt.Sprintf("You %s %s~RS to level: ~OL%s\n", verb, recap, levelName(newLevel)))
+	if online {
+		target.Write(fmt.Sprintf("~OLYou have been %sd to level: %s!\n", verb, levelName(newLevel)))
+	}
+}
+
+// setLevel puts a saved account straight onto a level, for example
+// "gotalker set-level Bob GOD". it is how the first staff account is made,
+// as nobody can promote a user to their own level. the talker should not be
+// running, or an online user will save over the change.
+func setLevel(name string, levelArg string) error {
+	level, err := levelByName(levelArg)
+	if err != nil {
+		return err
+	}
+
+	u, err := LoadUser(name)
+	if err == errUserNotFound {
+		return fmt.Errorf("there is no account called %s, log in once to make it", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	u.Lock()
+	oldLevel := u.Level
+	u.Level = level
+	u.Unlock()
+
+	if err = u.Save(); err != nil {
+		return err
+	}
+
+	writeAudit("%s set from %s to %s from the command line", name, levelName(oldLevel), levelName(level))
+	return nil
+}
+
+func cmdPromote(u *User, inpstr string) bool {
+	changeLevel(u, inpstr, 1)
+	return false
+}
+
+func cmdDemote(u *User, inpstr string) bool {
+	changeLevel(u, inpstr, -1)
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+const maxLineLen = 1024
+
+var errLineTooLong = errors.New("line too long")
+
+// lineReader assembles complete lines out of raw input, however it happens to
+// be split across reads. CR, LF and CRLF all end a line, and backspace or DEL
+// edit the line for clients that send a character at a time.
+type lineReader struct {
+	buf      []byte
+	lastCR   bool
+	overflow bool
+	pending  []string
+}
+
+// feed adds input to the current line and returns every line it completed.
+// lines longer than maxLineLen are thrown away and errLineTooLong returned
+// alongside whatever complete lines were read.
+func (l *lineReader) feed(input []byte) ([]string, error) {
+	var lines []string
+	var err error
+
+	for _, b := range input {
+		wasCR := l.lastCR
+		l.lastCR = false
+
+		switch b {
+		case '\r', '\n':
+			if b == '\n' && wasCR {
+				//second half of a CRLF
+				continue
+			}
+			l.lastCR = b == '\r'
+			if l.overflow {
+				err = errLineTooLong
+			} else {
+				lines = append(lines, string(l.buf))
+			}
+			l.buf = l.buf[:0]
+			l.overflow = false
+		case '\b', 0x7f:
+			if len(l.buf) > 0 {
+				_, size := utf8.DecodeLastRune(l.buf)
+				l.buf = l.buf[:len(l.buf)-size]
+			}
+		default:
+			if l.overflow {
+				continue
+			}
+			if len(l.buf) >= maxLineLen {
+				l.overflow = true
+				continue
+			}
+			l.buf = append(l.buf, b)
+		}
+	}
+
+	return lines, err
+}
+
+// next returns the next complete line, calling fill for more input until
+// there is one.
+func (l *lineReader) next(fill func() ([]byte, error)) (string, error) {
+	for len(l.pending) == 0 {
+		input, err := fill()
+		if err != nil {
+			return "", err
+		}
+		lines, err := l.feed(input)
+		l.pending = append(l.pending, lines...)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	line := l.pending[0]
+	l.pending = l.pending[1:]
+	return line, nil
+}
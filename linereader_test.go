@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineReaderFeed(t *testing.T) {
+	tests := []struct {
+		name  string
+		feeds []string
+		want  []string
+	}{
+		{"lf", []string{"one\ntwo\n"}, []string{"one", "two"}},
+		{"cr", []string{"one\rtwo\r"}, []string{"one", "two"}},
+		{"crlf", []string{"one\r\ntwo\r\n"}, []string{"one", "two"}},
+		{"crlf split", []string{"one\r", "\ntwo\r", "\n"}, []string{"one", "two"}},
+		{"line split", []string{"o", "n", "e\n"}, []string{"one"}},
+		{"blank lines", []string{"\r\n\n\r"}, []string{"", "", ""}},
+		{"lfcr", []string{"one\n\r"}, []string{"one", ""}},
+		{"unfinished", []string{"one\ntw"}, []string{"one"}},
+		{"backspace", []string{"onx\be\n"}, []string{"one"}},
+		{"delete", []string{"onx", "\x7fe\n"}, []string{"one"}},
+		{"backspace empty", []string{"\b\bone\n"}, []string{"one"}},
+		{"backspace utf8", []string{"café\b\bfe\n"}, []string{"cafe"}},
+	}
+
+	for _, test := range tests {
+		var l lineReader
+		var got []string
+		for _, input := range test.feeds {
+			lines, err := l.feed([]byte(input))
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", test.name, err)
+			}
+			got = append(got, lines...)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLineReaderTooLong(t *testing.T) {
+	var l lineReader
+	long := strings.Repeat("x", maxLineLen+1)
+
+	lines, err := l.feed([]byte("before\n" + long))
+	if err != nil || !reflect.DeepEqual(lines, []string{"before"}) {
+		t.Fatalf("got %q, %v before the end of the long line", lines, err)
+	}
+
+	lines, err = l.feed([]byte("more\nafter\n"))
+	if err != errLineTooLong {
+		t.Errorf("got error %v, want errLineTooLong", err)
+	}
+	if !reflect.DeepEqual(lines, []string{"after"}) {
+		t.Errorf("got %q after the long line, want [\"after\"]", lines)
+	}
+}
+
+func TestLineReaderNext(t *testing.T) {
+	var l lineReader
+	reads := []string{"one\r", "\ntwo\nthr", "ee\n"}
+	fill := func() ([]byte, error) {
+		input := reads[0]
+		reads = reads[1:]
+		return []byte(input), nil
+	}
+
+	for _, want := range []string{"one", "two", "three"} {
+		got, err := l.next(fill)
+		if err != nil || got != want {
+			t.Errorf("next() = %q, %v, want %q", got, err, want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type mail struct {
+	From    string    `json:"from"`
+	Sent    time.Time `json:"sent"`
+	Message string    `json:"message"`
+	Read    bool      `json:"read"`
+}
+
+type mailbox struct {
+	Messages []*mail `json:"messages"`
+}
+
+// mailLock is held for every read-modify-write of a mailbox so two people
+// mailing the same user can't lose each other's messages.
+var mailLock sync.Mutex
+
+// loadMailbox returns the user's mailbox, which is empty if they have never
+// been sent anything.
+func loadMailbox(name string) (*mailbox, error) {
+	m := &mailbox{}
+
+	data, err := userStore.GetMail(name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return m, nil
+	}
+
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Save writes the mailbox to the user store, removing it once it is empty.
+func (m *mailbox) Save(name string) error {
+	if len(m.Messages) == 0 {
+		return userStore.PutMail(name, nil)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return userStore.PutMail(name, data)
+}
+
+func (m *mailbox) Unread() int {
+	count := 0
+	for _, message := range m.Messages {
+		if !message.Read {
+			count++
+		}
+	}
+	return count
+}
+
+// unreadMail counts the messages the named user hasn't read yet.
+func unreadMail(name string) int {
+	mailLock.Lock()
+	defer mailLock.Unlock()
+
+	m, err := loadMailbox(name)
+	if err != nil {
+		fmt.Printf("unable to load mailbox for '%s': %s\n", name, err.Error())
+		return 0
+	}
+	return m.Unread()
+}
+
+// parseRange turns a list like "1,3,5-7" or "4-" into the set of message
+// numbers it covers, out of total messages.
+func parseRange(inpstr string, total int) (map[int]bool, error) {
+	selected := make(map[int]bool)
+	if inpstr == "all" {
+		for i := 1; i <= total; i++ {
+			selected[i] = true
+		}
+		return selected, nil
+	}
+
+	for _, part := range strings.Split(inpstr, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.New("invalid range")
+		}
+		end := start
+		if len(bounds) == 2 {
+			if bounds[1] == "" {
+				end = total
+			} else if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, errors.New("invalid range")
+			}
+		}
+		if start < 1 || end > total || start > end {
+			return nil, errors.New("range out of bounds")
+		}
+
+		for i := start; i <= end; i++ {
+			selected[i] = true
+		}
+	}
+
+	return selected, nil
+}
+
+func cmdSmail(u *User, inpstr string) bool {
+	spaceIndex := strings.Index(inpstr, " ")
+	if spaceIndex == -1 {
+		u.Write("Usage: smail <user> <text>\n")
+		return false
+	}
+	userName := inpstr[:spaceIndex]
+	message := strings.TrimSpace(inpstr[spaceIndex+1:])
+	if message == "" {
+		u.Write("Usage: smail <user> <text>\n")
+		return false
+	}
+
+	exists, err := userStore.Exists(userName)
+	if err != nil || !exists {
+		u.Write("There is no such user.\n")
+		return false
+	}
+
+	u.Lock()
+	from := u.Recap
+	u.Unlock()
+
+	mailLock.Lock()
+	m, err := loadMailbox(userName)
+	if err == nil {
+		m.Messages = append(m.Messages, &mail{from, time.Now(), message, false})
+		err = m.Save(userName)
+	}
+	mailLock.Unlock()
+
+	if err != nil {
+		fmt.Printf("unable to deliver mail to '%s': %s\n", userName, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	u.Write(fmt.Sprintf("Mail sent to %s.\n", userName))
+	if recipient, err := userList.FindByUserName(userName); err == nil {
+		recipient.Write("\n~FT~OL*** YOU HAVE NEW MAIL ***\n\n")
+	}
+	return false
+}
+
+func cmdRmail(u *User, inpstr string) bool {
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+
+	mailLock.Lock()
+	m, err := loadMailbox(name)
+	if err != nil {
+		mailLock.Unlock()
+		fmt.Printf("unable to load mailbox for '%s': %s\n", name, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	if len(m.Messages) == 0 {
+		mailLock.Unlock()
+		u.Write("You have no mail.\n")
+		return false
+	}
+
+	output := fmt.Sprintf("\n~BB~FG*** You have %d message(s) ***\n\n", len(m.Messages))
+	for i, message := range m.Messages {
+		marker := " "
+		if !message.Read {
+			marker = "~OL*~RS"
+		}
+		output += fmt.Sprintf("%s%3d) From: %s~RS  %s\n     %s\n\n", marker, i+1, message.From, message.Sent.Format(time.ANSIC), message.Message)
+		message.Read = true
+	}
+
+	err = m.Save(name)
+	mailLock.Unlock()
+	if err != nil {
+		fmt.Printf("unable to save mailbox for '%s': %s\n", name, err.Error())
+	}
+
+	u.Page(output + "~BB~FG*** End ***\n\n")
+	return false
+}
+
+func cmdDmail(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: dmail all|<number>[-<number>][,...]\n")
+		return false
+	}
+
+	u.Lock()
+	name := u.Name
+	u.Unlock()
+
+	mailLock.Lock()
+	m, err := loadMailbox(name)
+	if err != nil {
+		mailLock.Unlock()
+		fmt.Printf("unable to load mailbox for '%s': %s\n", name, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	if len(m.Messages) == 0 {
+		mailLock.Unlock()
+		u.Write("You have no mail.\n")
+		return false
+	}
+
+	selected, err := parseRange(inpstr, len(m.Messages))
+	if err != nil {
+		mailLock.Unlock()
+		u.Write(fmt.Sprintf("You have %d message(s), usage: dmail all|<number>[-<number>][,...]\n", len(m.Messages)))
+		return false
+	}
+
+	var kept []*mail
+	for i, message := range m.Messages {
+		if !selected[i+1] {
+			kept = append(kept, message)
+		}
+	}
+	m.Messages = kept
+
+	err = m.Save(name)
+	mailLock.Unlock()
+
+	if err != nil {
+		fmt.Printf("unable to save mailbox for '%s': %s\n", name, err.Error())
+		u.Write(syserror + "\n")
+		return false
+	}
+
+	u.Write(fmt.Sprintf("%d message(s) deleted, %d left.\n", len(selected), len(m.Messages)))
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		total   int
+		want    []int
+		wantErr bool
+	}{
+		{"all", 3, []int{1, 2, 3}, false},
+		{"all", 0, nil, false},
+		{"2", 3, []int{2}, false},
+		{"1,3", 3, []int{1, 3}, false},
+		{"1, 3", 3, []int{1, 3}, false},
+		{"2-4", 5, []int{2, 3, 4}, false},
+		{"4-", 5, []int{4, 5}, false},
+		{"1,3,5-7", 7, []int{1, 3, 5, 6, 7}, false},
+		{"1-3,2-4", 4, []int{1, 2, 3, 4}, false},
+		{"3-3", 3, []int{3}, false},
+		{"0", 3, nil, true},
+		{"4", 3, nil, true},
+		{"2-5", 3, nil, true},
+		{"3-1", 3, nil, true},
+		{"4-", 3, nil, true},
+		{"-2", 3, nil, true},
+		{"one", 3, nil, true},
+		{"1-two", 3, nil, true},
+		{"1,,2", 3, nil, true},
+		{"", 3, nil, true},
+	}
+
+	for _, test := range tests {
+		selected, err := parseRange(test.input, test.total)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseRange(%q, %d) = %v, want an error", test.input, test.total, selected)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q, %d) returned %s", test.input, test.total, err)
+			continue
+		}
+
+		var got []int
+		for i := 1; i <= test.total; i++ {
+			if selected[i] {
+				got = append(got, i)
+			}
+		}
+		if len(got) != len(selected) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRange(%q, %d) = %v, want %v", test.input, test.total, selected, test.want)
+		}
+	}
+}
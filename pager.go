@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// long output is shown to terminal users a screen at a time, using the
+// height their client reports or they have set. web clients scroll for
+// themselves and are sent everything at once.
+const pagerPrompt = "~BB~FG-- More (%d%%) --~RS return for more, q to stop: "
+
+// paged reports whether u's client needs long output split into screens.
+func (u *User) paged() bool {
+	return u.Conn.Capabilities().Paged
+}
+
+// Page writes output a screen at a time, waiting for the user between each.
+func (u *User) Page(output string) {
+	if !u.paged() {
+		u.Write(output)
+		return
+	}
+
+	lines := strings.SplitAfter(output, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	u.Lock()
+	u.pager = lines
+	u.pagerTotal = len(lines)
+	u.Unlock()
+	u.nextPage()
+}
+
+// nextPage writes as many waiting lines as fit on the screen, leaving a line
+// for the prompt. lines wider than the screen count once for each row they
+// wrap onto.
+func (u *User) nextPage() {
+	height, width := u.Height()-1, u.Width()
+
+	u.Lock()
+	rows, count := 0, 0
+	for count < len(u.pager) {
+		wrapped := (len(colorComStrip(strings.TrimSuffix(u.pager[count], "\n"))) + width - 1) / width
+		if wrapped < 1 {
+			wrapped = 1
+		}
+		if rows+wrapped > height && count > 0 {
+			break
+		}
+		rows += wrapped
+		count++
+	}
+	page := strings.Join(u.pager[:count], "")
+	u.pager = u.pager[count:]
+	left, total := len(u.pager), u.pagerTotal
+	if left == 0 {
+		u.pager = nil
+	}
+	u.Unlock()
+
+	u.Write(page)
+	if left > 0 {
+		u.Prompt(fmt.Sprintf(pagerPrompt, (total-left)*100/total), false)
+	}
+}
+
+// pagerInput takes a line typed at a more prompt. return shows the next
+// screen and q stops, anything else stops and is handled as usual. it
+// returns true if the line was used up.
+func (u *User) pagerInput(text string) bool {
+	u.Lock()
+	waiting := len(u.pager) > 0
+	if waiting && text != "" {
+		u.pager = nil
+	}
+	u.Unlock()
+
+	if !waiting {
+		return false
+	}
+	if text == "" {
+		u.nextPage()
+		return true
+	}
+	return strings.EqualFold(text, "q")
+}
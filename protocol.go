@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// web clients asking for this sub-protocol (or connecting with ?format=json)
+// are sent json events instead of ANSI text
+const jsonProtocol = "gotalker.json"
+
+const (
+	eventSay       = "say"
+	eventTell      = "tell"
+	eventEmote     = "emote"
+	eventSystem    = "system"
+	eventWhoUpdate = "who-update"
+	eventPrompt    = "prompt"
+	eventReconnect = "reconnect"
+	eventChannel   = "channel"
+)
+
+type span struct {
+	Text      string `json:"text"`
+	Fg        string `json:"fg,omitempty"`
+	Bg        string `json:"bg,omitempty"`
+	Bold      bool   `json:"bold,omitempty"`
+	Underline bool   `json:"underline,omitempty"`
+	Blink     bool   `json:"blink,omitempty"`
+	Reverse   bool   `json:"reverse,omitempty"`
+}
+
+type whoUser struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Room        string `json:"room"`
+}
+
+type event struct {
+	Type    string    `json:"type"`
+	Sender  string    `json:"sender,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	Channel string    `json:"channel,omitempty"`
+	Time    time.Time `json:"time"`
+	Text    string    `json:"text"`
+	Spans   []span    `json:"spans,omitempty"`
+	Mask    bool      `json:"mask,omitempty"`
+	Users   []whoUser `json:"users,omitempty"`
+	Token   string    `json:"token,omitempty"`
+}
+
+func newEvent(eventType string, sender *User, room *Room, text string) *event {
+	ev := &event{Type: eventType, Time: time.Now(), Text: text}
+	if sender != nil {
+		sender.Lock()
+		ev.Sender = sender.Name
+		sender.Unlock()
+	}
+	if room != nil {
+		ev.Room = room.Name
+	}
+	return ev
+}
+
+// Send delivers an event, as json to clients that asked for it and as plain
+// text to everyone else.
+func (u *User) Send(ev *event) {
+	caps := u.capabilities()
+	if !caps.JSON {
+		u.writeText(ev.Text)
+		return
+	}
+
+	wire := *ev
+	if caps.Color != colorNone {
+		wire.Spans = colorSpans(ev.Text)
+	}
+	wire.Text = colorComStrip(ev.Text)
+	data, err := json.Marshal(&wire)
+	if err != nil {
+		fmt.Printf("unable to encode event: %s\n", err.Error())
+		return
+	}
+
+	u.Conn.Write(data)
+}
+
+// Prompt asks the user for input. json clients are told whether the input
+// should be masked, everyone else gets the text and telnet echo handling.
+func (u *User) Prompt(str string, mask bool) {
+	ev := newEvent(eventPrompt, nil, nil, str)
+	ev.Mask = mask
+	u.Send(ev)
+}
+
+func sendRoom(ulist *users, room *Room, ev *event) {
+	for _, u := range ulist.online() {
+		u.Lock()
+		inRoom := u.Room == room
+		u.Unlock()
+		if inRoom && !u.ignores(ev.Sender, ignoreSpeech) {
+			u.Send(ev)
+		}
+	}
+}
+
+// sendWhoUpdate tells json clients who is online and where they are.
+func sendWhoUpdate() {
+	ev := newEvent(eventWhoUpdate, nil, nil, "")
+
+	online := userList.online()
+
+	var listeners []*User
+	for _, u := range online {
+		if u.Conn.Capabilities().JSON {
+			listeners = append(listeners, u)
+		}
+		u.Lock()
+		entry := whoUser{u.Name, colorComStrip(u.Description), ""}
+		if u.Room != nil {
+			entry.Room = u.Room.Name
+		}
+		u.Unlock()
+		ev.Users = append(ev.Users, entry)
+	}
+
+	for _, u := range listeners {
+		u.Send(ev)
+	}
+}
+
+// colorSpans splits colour coded text into runs of text sharing a style.
+func colorSpans(str string) []span {
+	var spans []span
+	for _, run := range tokenize(str) {
+		if run.text == "" {
+			continue
+		}
+		current := span{
+			Text:      run.text,
+			Bold:      run.style.bold,
+			Underline: run.style.underline,
+			Blink:     run.style.blink,
+			Reverse:   run.style.reverse,
+		}
+		if run.style.fg.set {
+			current.Fg = run.style.fg.hex()
+		}
+		if run.style.bg.set {
+			current.Bg = run.style.bg.hex()
+		}
+		spans = append(spans, current)
+	}
+	return spans
+}
+
+// webHandshake does the usual origin check and picks the json protocol if
+// the client offered it.
+func webHandshake(config *websocket.Config, req *http.Request) error {
+	var err error
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return fmt.Errorf("null origin")
+	}
+
+	offered := config.Protocol
+	config.Protocol = nil
+	for _, protocol := range offered {
+		if protocol == jsonProtocol {
+			config.Protocol = []string{jsonProtocol}
+			break
+		}
+	}
+
+	return err
+}
+
+func wantsJSON(conn *websocket.Conn) bool {
+	for _, protocol := range conn.Config().Protocol {
+		if protocol == jsonProtocol {
+			return true
+		}
+	}
+	return conn.Request().URL.Query().Get("format") == "json"
+}
+
+// wantsHTML is for web clients that would rather be sent html than ANSI.
+func wantsHTML(conn *websocket.Conn) bool {
+	return conn.Request().URL.Query().Get("format") == "html"
+}
+
+// jsonInput unwraps {"text": "..."} messages from json clients, anything else
+// is taken as typed.
+func jsonInput(message string) string {
+	if !strings.HasPrefix(strings.TrimSpace(message), "{") {
+		return message
+	}
+
+	var input struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(message), &input); err != nil {
+		return message
+	}
+	return input.Text
+}
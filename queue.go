@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// output to each connection goes through a queue drained by its own writer,
+// so broadcasting never waits on the network. a client that stops reading
+// first loses its oldest output and is then disconnected.
+const (
+	outputQueueLen     = 512
+	outputStallMax     = outputQueueLen
+	outputFlushTimeout = 2 * time.Second
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// output dropped and slow clients disconnected since boot
+var outputStats struct {
+	sync.Mutex
+	dropped         int
+	slowDisconnects int
+}
+
+type outputQueue struct {
+	Connection
+	pending [][]byte
+	ready   chan struct{}
+	done    chan struct{}
+	sync.Mutex
+
+	writing   bool
+	closing   bool
+	stalled   int
+	dropped   int
+	highWater int
+}
+
+// replier is a connection that answers its client by itself, as telnet
+// does when negotiating options. the answers go through the queue so they
+// keep their place among the rest of the output.
+type replier interface {
+	sendRepliesTo(write func(data []byte) error)
+}
+
+func newOutputQueue(conn Connection) *outputQueue {
+	q := &outputQueue{
+		Connection: conn,
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if client, ok := conn.(replier); ok {
+		client.sendRepliesTo(q.Write)
+	}
+	go q.run()
+	return q
+}
+
+// Write queues the data and returns straight away.
+func (q *outputQueue) Write(data []byte) error {
+	q.Lock()
+	if q.closing {
+		q.Unlock()
+		return errConnectionClosed
+	}
+
+	if len(q.pending) >= outputQueueLen {
+		q.pending = q.pending[1:]
+		q.dropped++
+		q.stalled++
+		outputStats.Lock()
+		outputStats.dropped++
+		outputStats.Unlock()
+
+		if q.stalled > outputStallMax {
+			q.closing = true
+			q.pending = nil
+			q.Unlock()
+
+			outputStats.Lock()
+			outputStats.slowDisconnects++
+			outputStats.Unlock()
+			fmt.Printf("disconnecting %s, it has stopped reading its output\n", q.RemoteAddr())
+			q.Connection.Close()
+			return errConnectionClosed
+		}
+	}
+
+	q.pending = append(q.pending, data)
+	if len(q.pending) > q.highWater {
+		q.highWater = len(q.pending)
+	}
+	q.Unlock()
+
+	q.signal()
+	return nil
+}
+
+func (q *outputQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run writes out everything queued until the queue is closed and empty.
+func (q *outputQueue) run() {
+	defer close(q.done)
+	for {
+		q.Lock()
+		for len(q.pending) == 0 && !q.closing {
+			q.Unlock()
+			<-q.ready
+			q.Lock()
+		}
+		if len(q.pending) == 0 {
+			q.Unlock()
+			return
+		}
+		batch := q.pending
+		q.pending = nil
+		q.writing = true
+		q.Unlock()
+
+		for _, data := range batch {
+			if err := q.Connection.Write(data); err != nil {
+				q.Lock()
+				q.closing = true
+				q.pending = nil
+				q.writing = false
+				q.Unlock()
+				return
+			}
+		}
+
+		q.Lock()
+		q.writing = false
+		q.stalled = 0
+		q.Unlock()
+	}
+}
+
+// flush waits until everything queued so far has been written, or the
+// timeout runs out.
+func (q *outputQueue) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		q.Lock()
+		idle := len(q.pending) == 0 && !q.writing
+		q.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close lets the writer finish sending what is queued before closing the
+// connection underneath, giving up on clients that aren't reading.
+func (q *outputQueue) Close() error {
+	q.Lock()
+	alreadyClosing := q.closing
+	q.closing = true
+	q.Unlock()
+
+	if !alreadyClosing {
+		q.signal()
+		select {
+		case <-q.done:
+		case <-time.After(outputFlushTimeout):
+		}
+	}
+	return q.Connection.Close()
+}
+
+// depth reports how much output is waiting, the most there has ever been
+// and how much has been thrown away.
+func (q *outputQueue) depth() (pending int, highWater int, dropped int) {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.pending), q.highWater, q.dropped
+}
+
+// transport returns the connection underneath any output queue.
+func transport(conn Connection) Connection {
+	if q, ok := conn.(*outputQueue); ok {
+		return q.Connection
+	}
+	return conn
+}
+
+func cmdQueues(u *User, inpstr string) bool {
+	online := userList.online()
+
+	output := "\n~BB~FG*** Output queues ***\n\n"
+	output += fmt.Sprintf("%-16s %8s %8s %8s\n", "Name", "Queued", "Most", "Dropped")
+	for _, current := range online {
+		q, ok := current.Conn.(*outputQueue)
+		if !ok {
+			continue
+		}
+		pending, highWater, dropped := q.depth()
+		current.Lock()
+		name := current.Name
+		current.Unlock()
+		output += fmt.Sprintf("%-16s %8d %8d %8d\n", name, pending, highWater, dropped)
+	}
+
+	outputStats.Lock()
+	output += fmt.Sprintf("\nQueues hold %d messages. %d dropped and %d slow client(s) disconnected since boot.\n", outputQueueLen, outputStats.dropped, outputStats.slowDisconnects)
+	outputStats.Unlock()
+
+	u.Write(output + "\n~BB~FG*** End ***\n\n")
+	return false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stuckConn is a client that doesn't read anything until it is released.
+// entered is told when the first write starts to block.
+type stuckConn struct {
+	sync.Mutex
+	written [][]byte
+	closed  bool
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newStuckConn() *stuckConn {
+	return &stuckConn{entered: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (c *stuckConn) ReadLine() (string, error) { return "", errConnectionClosed }
+
+func (c *stuckConn) Write(data []byte) error {
+	select {
+	case c.entered <- struct{}{}:
+	default:
+	}
+	<-c.release
+
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errConnectionClosed
+	}
+	c.written = append(c.written, data)
+	return nil
+}
+
+func (c *stuckConn) unstick() {
+	c.once.Do(func() { close(c.release) })
+}
+
+func (c *stuckConn) Close() error {
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.unstick()
+	return nil
+}
+
+func (c *stuckConn) RemoteAddr() string         { return "127.0.0.1:1" }
+func (c *stuckConn) Capabilities() capabilities { return capabilities{} }
+func (c *stuckConn) SetEcho(on bool) error      { return nil }
+
+// writes is what the client has read so far and whether it was closed.
+func (c *stuckConn) writes() (written [][]byte, closed bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.written, c.closed
+}
+
+func TestOutputQueueSlowClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		extra  int
+		closed bool
+	}{
+		{"full", 0, false},
+		{"drops one", 1, false},
+		{"drops some", 10, false},
+		{"last drop", outputStallMax, false},
+		{"disconnected", outputStallMax + 1, true},
+	}
+
+	for _, test := range tests {
+		conn := newStuckConn()
+		q := newOutputQueue(conn)
+
+		//the first write is taken by the writer and sticks there
+		q.Write([]byte("first"))
+		select {
+		case <-conn.entered:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the queue never wrote to the connection", test.name)
+		}
+
+		var err error
+		for i := 0; i < outputQueueLen+test.extra; i++ {
+			err = q.Write([]byte(strconv.Itoa(i)))
+		}
+
+		if test.closed {
+			if err != errConnectionClosed {
+				t.Errorf("%s: last write returned %v, want errConnectionClosed", test.name, err)
+			}
+			if q.Write([]byte("after")) != errConnectionClosed {
+				t.Errorf("%s: a write after the disconnect was accepted", test.name)
+			}
+			if _, closed := conn.writes(); !closed {
+				t.Errorf("%s: the connection was left open", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: last write returned %v", test.name, err)
+		}
+		pending, highWater, dropped := q.depth()
+		if pending != outputQueueLen || highWater != outputQueueLen || dropped != test.extra {
+			t.Errorf("%s: depth() = %d, %d, %d, want %d, %d, %d", test.name,
+				pending, highWater, dropped, outputQueueLen, outputQueueLen, test.extra)
+		}
+
+		//once the client reads again it gets the newest output, in order
+		conn.unstick()
+		q.flush(time.Second)
+		written, _ := conn.writes()
+		if len(written) != outputQueueLen+1 || string(written[0]) != "first" {
+			t.Fatalf("%s: %d writes, want %d starting with \"first\"", test.name, len(written), outputQueueLen+1)
+		}
+		for i, data := range written[1:] {
+			if want := strconv.Itoa(i + test.extra); string(data) != want {
+				t.Errorf("%s: write %d was %q, want %q", test.name, i+1, data, want)
+				break
+			}
+		}
+		q.Close()
+	}
+}
+
+func TestOutputQueueTelnetReplies(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newTelnetConn(server)
+	q := newOutputQueue(conn)
+	defer q.Close()
+	go conn.ReadLine()
+
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatal(what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	//nothing is read yet, so the first write sticks in the writer
+	q.Write([]byte("a"))
+	waitFor("the queue never started writing", func() bool {
+		q.Lock()
+		defer q.Unlock()
+		return q.writing && len(q.pending) == 0
+	})
+
+	//the answer waits its turn in the queue rather than on the socket
+	client.Write([]byte{telnetIAC, telnetDO, telnetOptSGA})
+	waitFor("the answer to DO SGA never reached the queue", func() bool {
+		pending, _, _ := q.depth()
+		return pending == 1
+	})
+	q.SetEcho(false)
+	q.Write([]byte("b"))
+
+	want := []byte{'a', telnetIAC, telnetWILL, telnetOptSGA, telnetIAC, telnetWILL, telnetOptEcho, 'b'}
+	got := make([]byte, 0, len(want))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < len(want) {
+		buffer := make([]byte, len(want))
+		n, err := client.Read(buffer)
+		if err != nil {
+			t.Fatalf("read %v then %s", got, err)
+		}
+		got = append(got, buffer[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("client read %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	roomFiles       = "datafiles/rooms/"
+	defaultRoomName = "main"
+	roomTopicLen    = 60
+)
+
+type Room struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Topic       string   `json:"topic"`
+	Links       []string `json:"links"`
+	sync.Mutex  `json:"-"`
+
+	file  string
+	board *board
+}
+
+type rooms []*Room
+
+var roomList rooms
+
+var roomListLock sync.Mutex
+
+var mainRoom *Room
+
+func LoadRoomFromFile(filepath string) (*Room, error) {
+	r := &Room{}
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Room) SaveToFile(savePath string) error {
+	r.Lock()
+	data, err := json.MarshalIndent(r, "", "\t")
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path.Dir(savePath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.MkdirAll(path.Dir(savePath), 0700); err != nil {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(savePath, data, 0600)
+}
+
+// LinkedTo reports whether there is an exit from r to the named room.
+func (r *Room) LinkedTo(name string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, link := range r.Links {
+		if strings.EqualFold(link, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rlist *rooms) FindByName(name string) (*Room, error) {
+	roomListLock.Lock()
+	defer roomListLock.Unlock()
+	for _, r := range *rlist {
+		if strings.EqualFold(r.Name, name) {
+			return r, nil
+		}
+	}
+	return nil, errors.New("unable to find room")
+}
+
+// loadRooms reads every room definition in roomDir. the room named in the
+// config becomes the login room, otherwise the first one found is used.
+func loadRooms(roomDir string) error {
+	files, err := ioutil.ReadDir(roomDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read room directory: %s", err.Error())
+	}
+
+	loaded := rooms{}
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".json" {
+			continue
+		}
+		r, err := LoadRoomFromFile(roomDir + file.Name())
+		if err != nil {
+			return fmt.Errorf("unable to load room '%s': %s", file.Name(), err.Error())
+		}
+		r.file = roomDir + file.Name()
+		loaded = append(loaded, r)
+	}
+
+	if len(loaded) == 0 {
+		loaded = append(loaded, &Room{Name: defaultRoomName, Description: "An empty room.", file: roomDir + defaultRoomName + ".json"})
+	}
+
+	for _, r := range loaded {
+		r.board, err = loadBoard(boardFiles + r.Name + ".json")
+		if err != nil {
+			return fmt.Errorf("unable to load board for '%s': %s", r.Name, err.Error())
+		}
+	}
+
+	roomListLock.Lock()
+	roomList = loaded
+	roomListLock.Unlock()
+
+	mainRoom = loaded[0]
+	if name := getConfig().MainRoom; name != "" {
+		r, err := roomList.FindByName(name)
+		if err != nil {
+			return fmt.Errorf("main room '%s' is not defined", name)
+		}
+		mainRoom = r
+	}
+
+	return nil
+}
+
+func writeRoom(ulist *users, room *Room, buffer string) {
+	for _, u := range ulist.online() {
+		u.Lock()
+		inRoom := u.Room == room
+		u.Unlock()
+		if inRoom {
+			u.Write(buffer)
+		}
+	}
+}
+
+// writeRoomExcept writes to everyone in the room apart from the given user.
+func writeRoomExcept(ulist *users, room *Room, except *User, buffer string) {
+	for _, u := range ulist.online() {
+		if u == except {
+			continue
+		}
+		u.Lock()
+		inRoom := u.Room == room
+		u.Unlock()
+		if inRoom {
+			u.Write(buffer)
+		}
+	}
+}
+
+func (u *User) CurrentRoom() *Room {
+	u.Lock()
+	defer u.Unlock()
+	return u.Room
+}
+
+func look(u *User) {
+	room := u.CurrentRoom()
+	room.Lock()
+	name := room.Name
+	desc := room.Description
+	topic := room.Topic
+	links := strings.Join(room.Links, "  ")
+	room.Unlock()
+
+	var here []string
+	userListLock.Lock()
+	for _, other := range userList {
+		if other == u {
+			continue
+		}
+		other.Lock()
+		if other.Room == room {
+			here = append(here, fmt.Sprintf("    %s~RS %s~RS", other.Recap, other.Description))
+		}
+		other.Unlock()
+	}
+	userListLock.Unlock()
+
+	output := fmt.Sprintf("\n~FM~OLRoom: ~RS~OL%s\n\n%s\n\n", name, desc)
+	if links == "" {
+		output += "~FTThere are no exits.\n"
+	} else {
+		output += fmt.Sprintf("~FTExits are:~RS  %s\n", links)
+	}
+	if len(here) == 0 {
+		output += "\n~FGYou are all alone here.\n"
+	} else {
+		output += "\n~FGYou can see:\n" + strings.Join(here, "\n") + "\n"
+	}
+	if topic == "" {
+		output += "\nNo topic has been set yet.\n"
+	} else {
+		output += fmt.Sprintf("\n~FGCurrent topic:~RS %s\n", topic)
+	}
+	u.Write(output)
+}
+
+func moveUser(u *User, room *Room) {
+	u.Lock()
+	oldRoom := u.Room
+	name := u.Recap
+	u.Room = room
+	u.Unlock()
+
+	if oldRoom != nil {
+		writeRoom(&userList, oldRoom, fmt.Sprintf("%s goes to the %s\n", name, room.Name))
+	}
+	writeRoomExcept(&userList, room, u, fmt.Sprintf("%s has arrived.\n", name))
+	sendWhoUpdate()
+	look(u)
+}
+
+func cmdGo(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Usage: go <room>\n")
+		return false
+	}
+
+	room, err := roomList.FindByName(inpstr)
+	if err != nil {
+		u.Write("There is no such room.\n")
+		return false
+	}
+
+	current := u.CurrentRoom()
+	if room == current {
+		u.Write(fmt.Sprintf("You are already in the %s!\n", room.Name))
+		return false
+	}
+	if !current.LinkedTo(room.Name) {
+		u.Write(fmt.Sprintf("The %s is not adjoined to here.\n", room.Name))
+		return false
+	}
+
+	moveUser(u, room)
+	return false
+}
+
+func cmdLook(u *User, inpstr string) bool {
+	look(u)
+	return false
+}
+
+func cmdRooms(u *User, inpstr string) bool {
+	counts := make(map[*Room]int)
+	userListLock.Lock()
+	for _, other := range userList {
+		other.Lock()
+		counts[other.Room]++
+		other.Unlock()
+	}
+	userListLock.Unlock()
+
+	output := "\n~FM~OLRoom name            Users  Topic\n\n"
+	roomListLock.Lock()
+	for _, r := range roomList {
+		r.Lock()
+		output += fmt.Sprintf("%-20s %5d  %s~RS\n", r.Name, counts[r], r.Topic)
+		r.Unlock()
+	}
+	roomListLock.Unlock()
+	u.Write(output + "\n")
+	return false
+}
+
+func cmdTopic(u *User, inpstr string) bool {
+	room := u.CurrentRoom()
+	if inpstr == "" {
+		room.Lock()
+		topic := room.Topic
+		room.Unlock()
+		if topic == "" {
+			u.Write("No topic has been set yet.\n")
+		} else {
+			u.Write(fmt.Sprintf("The current topic is: %s\n", topic))
+		}
+		return false
+	}
+
+	if len(inpstr) > roomTopicLen {
+		u.Write("Topic too long.\n")
+		return false
+	}
+
+	room.Lock()
+	room.Topic = inpstr
+	room.Unlock()
+
+	err := room.SaveToFile(room.file)
+	if err != nil {
+		fmt.Printf("unable to save room file for '%s': %s\n", room.Name, err.Error())
+	}
+
+	u.Lock()
+	recap := u.Recap
+	u.Unlock()
+	writeRoom(&userList, room, fmt.Sprintf("%s~RS has set the topic to: %s\n", recap, inpstr))
+	return false
+}
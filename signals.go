@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals shuts the talker down cleanly on SIGINT or SIGTERM and
+// reloads its data files on SIGHUP.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			fmt.Println("SIGHUP received, reloading")
+			reloadTalker()
+			continue
+		}
+
+		fmt.Printf("%s received, shutting down\n", sig)
+		go shutdownTalker(false)
+	}
+}
+
+// reloadTalker re-reads the config, tls certificate, colour codes, motds and
+// command templates without touching anyone who is connected. anything that
+// fails to load is left as it was.
+func reloadTalker() {
+	newConfig, err := loadConfig(configLocation)
+	if err != nil {
+		fmt.Printf("unable to reload config: %s\n", err.Error())
+	} else {
+		oldConfig := getConfig()
+		if newConfig.Mainport != oldConfig.Mainport || newConfig.Webport != oldConfig.Webport ||
+			newConfig.TLSPort != oldConfig.TLSPort || newConfig.HTTPSPort != oldConfig.HTTPSPort || newConfig.SSHPort != oldConfig.SSHPort {
+			fmt.Println("port changes will not take effect until the next reboot")
+		}
+		if newConfig.UserStore != oldConfig.UserStore || newConfig.UserStorePath != oldConfig.UserStorePath {
+			fmt.Println("user store changes will not take effect until the next reboot")
+		}
+		reloadLock.Lock()
+		talkerConfig = newConfig
+		reloadLock.Unlock()
+	}
+
+	if tlsEnabled() {
+		cfg := getConfig()
+		err = loadCertificate(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fmt.Printf("unable to reload certificate: %s\n", err.Error())
+		}
+	}
+
+	codes, err := loadColorCodes(colorCodeFile)
+	if err != nil {
+		fmt.Printf("unable to reload color codes: %s\n", err.Error())
+	} else {
+		reloadLock.Lock()
+		colorCodesList = codes
+		reloadLock.Unlock()
+	}
+
+	err = countMotds(motdFiles)
+	if err != nil {
+		fmt.Printf("unable to reload motds: %s\n", err.Error())
+	}
+
+	err = loadCommandTemplates(comTemplates)
+	if err != nil {
+		fmt.Printf("unable to reload command templates: %s\n", err.Error())
+	}
+
+	talkerSystem.Lock()
+	fmt.Printf("Reload complete, there are %d login motds and %d post-login motds\n", talkerSystem.Motd1Count, talkerSystem.Motd2Count)
+	talkerSystem.Unlock()
+}
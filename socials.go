@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const socialsFile = "datafiles/socials.json"
+
+// social is a verb like hug or wave. each message is a template given the
+// recapped names of the .Actor and the .Target.
+type social struct {
+	Name       string `json:"name"`
+	Untargeted string `json:"untargeted"` //seen by the room when no one is named
+	Self       string `json:"self"`       //seen by the actor when someone is named
+	Targeted   string `json:"targeted"`   //seen by the person named
+	Observer   string `json:"observer"`   //seen by everyone else in the room
+
+	untargeted *template.Template
+	self       *template.Template
+	targeted   *template.Template
+	observer   *template.Template
+}
+
+var socials map[string]*social
+
+// loadSocials reads the social definitions and adds each one to the command
+// table, skipping any that would replace a real command.
+func loadSocials(socialPath string) error {
+	socials = make(map[string]*social)
+
+	data, err := ioutil.ReadFile(socialPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var loaded []*social
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range loaded {
+		if _, ok := commands[s.Name]; ok {
+			fmt.Printf("social '%s' has the same name as a command, skipping it\n", s.Name)
+			continue
+		}
+
+		for _, t := range []struct {
+			text string
+			dest **template.Template
+		}{
+			{s.Untargeted, &s.untargeted},
+			{s.Self, &s.self},
+			{s.Targeted, &s.targeted},
+			{s.Observer, &s.observer},
+		} {
+			if t.text == "" {
+				continue
+			}
+			*t.dest, err = template.New(s.Name).Parse(t.text)
+			if err != nil {
+				return fmt.Errorf("unable to parse social '%s': %s", s.Name, err.Error())
+			}
+		}
+
+		if s.untargeted == nil && (s.self == nil || s.targeted == nil || s.observer == nil) {
+			return fmt.Errorf("social '%s' needs an untargeted message or all of the targeted ones", s.Name)
+		}
+
+		socials[s.Name] = s
+		commands[s.Name] = &command{LevelNew, s.run}
+	}
+
+	return nil
+}
+
+func renderSocial(t *template.Template, actor, target string) string {
+	var output bytes.Buffer
+	err := t.Execute(&output, struct {
+		Actor  string
+		Target string
+	}{actor, target})
+	if err != nil {
+		fmt.Printf("unable to render social: %s\n", err.Error())
+		return ""
+	}
+	return output.String() + "\n"
+}
+
+func (s *social) run(u *User, inpstr string) bool {
+	room := u.CurrentRoom()
+	u.Lock()
+	actor := u.Recap
+	u.Unlock()
+
+	targetName := strings.TrimSpace(inpstr)
+	if targetName == "" {
+		if s.untargeted == nil {
+			u.Write(fmt.Sprintf("Usage: %s <user>\n", s.Name))
+			return false
+		}
+		sendRoom(&userList, room, newEvent(eventEmote, u, room, renderSocial(s.untargeted, actor, "")))
+		return false
+	}
+
+	if s.targeted == nil {
+		u.Write(fmt.Sprintf("Usage: %s\n", s.Name))
+		return false
+	}
+
+	target, err := userList.FindByUserName(targetName)
+	if err != nil || target.CurrentRoom() != room {
+		u.Write("There is no one of that name here.\n")
+		return false
+	}
+	if target == u {
+		u.Write("You cannot do that to yourself.\n")
+		return false
+	}
+
+	target.Lock()
+	targetRecap := target.Recap
+	target.Unlock()
+
+	u.Send(newEvent(eventEmote, u, room, renderSocial(s.self, actor, targetRecap)))
+	targeted := newEvent(eventEmote, u, room, renderSocial(s.targeted, actor, targetRecap))
+	if !target.ignores(targeted.Sender, ignoreSpeech) {
+		target.Send(targeted)
+	}
+
+	observed := newEvent(eventEmote, u, room, renderSocial(s.observer, actor, targetRecap))
+	for _, other := range userList.online() {
+		if other != u && other != target && other.CurrentRoom() == room && !other.ignores(observed.Sender, ignoreSpeech) {
+			other.Send(observed)
+		}
+	}
+	return false
+}
+
+func cmdEmote(u *User, inpstr string) bool {
+	if inpstr == "" {
+		u.Write("Emote what?\n")
+		return false
+	}
+
+	room := u.CurrentRoom()
+	u.Lock()
+	name := u.Recap
+	u.Unlock()
+
+	//no space for possessives, "bob's"
+	if !strings.HasPrefix(inpstr, "'") {
+		inpstr = " " + inpstr
+	}
+	sendRoom(&userList, room, newEvent(eventEmote, u, room, fmt.Sprintf("%s~RS%s\n", name, inpstr)))
+	return false
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// users on the ssh port log in with their talker name and either their
+// password or a key they have registered with .sshkey, and go straight in.
+const (
+	sshKeysMax       = 10
+	sshServerVersion = "SSH-2.0-GoTalker"
+)
+
+var sshListener net.Listener
+var sshConfig *ssh.ServerConfig
+
+func loadSSHConfig(hostKeyPath string) (*ssh.ServerConfig, error) {
+	if hostKeyPath == "" {
+		return nil, errors.New("no ssh_host_key has been configured")
+	}
+
+	data, err := ioutil.ReadFile(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKey, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read host key: %s", err.Error())
+	}
+
+	maxAttempts := getConfig().LoginAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = loginAttempts
+	}
+
+	newConfig := &ssh.ServerConfig{
+		MaxAuthTries:      maxAttempts,
+		PasswordCallback:  sshPassword,
+		PublicKeyCallback: sshPublicKey,
+		ServerVersion:     sshServerVersion,
+	}
+	newConfig.AddHostKey(hostKey)
+	return newConfig, nil
+}
+
+// sshAccount loads the account someone is trying to log in to.
+func sshAccount(name string) (*User, error) {
+	if validName(name) != nil || banList.UserBanned(name) {
+		return nil, errors.New("login refused")
+	}
+	return LoadUser(name)
+}
+
+// sshDummyHash is checked against when there is no password to check, so a
+// missing account takes as long to refuse as a wrong password.
+const sshDummyHash = "$2a$10$qeCEwtGk5JTLAOzCOJVd1uEnFM.sYqpdl56/vVSGs1JSvAX6edjCa"
+
+func sshPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	hash := sshDummyHash
+	account, err := sshAccount(meta.User())
+	if err == nil && account.Password != "" {
+		hash = account.Password
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), password) != nil || hash == sshDummyHash {
+		return nil, errors.New("incorrect login")
+	}
+	return nil, nil
+}
+
+func sshPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	account, err := sshAccount(meta.User())
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range account.SSHKeys {
+		registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(registered.Marshal(), key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, errors.New("unknown key")
+}
+
+func serveSSH(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("unable to accept ssh socket", err)
+			continue
+		}
+
+		go acceptSSHConnection(conn)
+	}
+}
+
+// acceptSSHConnection does the ssh handshake and waits for the client to ask
+// for a shell. only one session is allowed per connection.
+func acceptSSHConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTime()))
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, sshConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	go ssh.DiscardRequests(requests)
+
+	started := false
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" || started {
+			newChannel.Reject(ssh.Prohibited, "only one session is allowed")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		started = true
+
+		client := &sshConn{conn: serverConn, channel: channel, buffer: make([]byte, 2048), echo: true}
+		go client.handleRequests(channelRequests, func() {
+			go sshSession(client, serverConn.User())
+		})
+	}
+}
+
+// sshSession puts an authenticated user straight into the talker.
+func sshSession(client *sshConn, name string) {
+	u, _ := NewUser()
+	u.Conn = newOutputQueue(client)
+
+	if banList.SiteBanned(u.site()) {
+		u.Write("\nLogins from your site/domain are banned.\n\n")
+		u.Close()
+		return
+	}
+	if !canConnect(u) {
+		return
+	}
+
+	err := u.Load(name)
+	if err != nil {
+		fmt.Printf("unable to load user file for '%s': %s\n", name, err.Error())
+		u.Write(fmt.Sprintf("\n%s: unable to load your account.\n\n", syserror))
+		u.Close()
+		return
+	}
+
+	u.Lock()
+	u.Login = LoginLogged
+	u.LastInput = time.Now()
+	u.Unlock()
+
+	talkerSystem.Lock()
+	talkerSystem.LoginCount++
+	talkerSystem.Unlock()
+
+	//without a pty there is nothing to say whether colour works, so the
+	//user is asked and the login finishes as it would for telnet
+	if u.asksColor() {
+		u.Lock()
+		u.Login = LoginColor
+		u.Unlock()
+		u.Prompt(colorQuestion, false)
+		readInput(u)
+		return
+	}
+
+	loginNotices(u)
+	u.Write("\n\n")
+	userList.AddUser(u)
+	connectUser(u)
+	readInput(u)
+}
+
+// sshConn is a session channel on an ssh connection. clients with a pty
+// expect the server to echo what they type and to send CRLF line endings. as
+// with telnet, writeLock is kept apart from the terminal state.
+type sshConn struct {
+	conn      *ssh.ServerConn
+	channel   ssh.Channel
+	lines     lineReader
+	buffer    []byte
+	writeLock sync.Mutex
+	sync.Mutex
+
+	pty      bool
+	echo     bool
+	typed    int
+	lastCR   bool
+	width    int
+	height   int
+	termType string
+}
+
+// handleRequests deals with the requests made on the session channel,
+// calling start once the client asks for a shell.
+func (c *sshConn) handleRequests(requests <-chan *ssh.Request, start func()) {
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "pty-req":
+			var pty struct {
+				Term        string
+				Width       uint32
+				Height      uint32
+				PixelWidth  uint32
+				PixelHeight uint32
+				Modes       string
+			}
+			if ssh.Unmarshal(req.Payload, &pty) == nil {
+				c.Lock()
+				c.pty = true
+				c.termType = strings.ToLower(pty.Term)
+				c.width = int(pty.Width)
+				c.height = int(pty.Height)
+				c.Unlock()
+				ok = true
+			}
+		case "window-change":
+			var size struct {
+				Width       uint32
+				Height      uint32
+				PixelWidth  uint32
+				PixelHeight uint32
+			}
+			if ssh.Unmarshal(req.Payload, &size) == nil {
+				c.Lock()
+				c.width = int(size.Width)
+				c.height = int(size.Height)
+				c.Unlock()
+				ok = true
+			}
+		case "shell":
+			ok = start != nil
+		}
+
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if req.Type == "shell" && start != nil {
+			start()
+			start = nil
+		}
+	}
+}
+
+func (c *sshConn) ReadLine() (string, error) {
+	return c.lines.next(func() ([]byte, error) {
+		n, err := c.channel.Read(c.buffer)
+		var reply []byte
+		c.Lock()
+		if c.pty {
+			reply = c.echoInput(c.buffer[:n])
+		}
+		c.Unlock()
+		if len(reply) > 0 {
+			c.writeLock.Lock()
+			c.channel.Write(reply)
+			c.writeLock.Unlock()
+		}
+		return c.buffer[:n], err
+	})
+}
+
+// echoInput works out what should be echoed back for input typed into a pty.
+func (c *sshConn) echoInput(input []byte) []byte {
+	var output []byte
+	for _, b := range input {
+		wasCR := c.lastCR
+		c.lastCR = false
+
+		switch {
+		case b == '\r' || b == '\n':
+			if b == '\n' && wasCR {
+				continue
+			}
+			c.lastCR = b == '\r'
+			c.typed = 0
+			output = append(output, '\r', '\n')
+		case b == '\b' || b == 0x7f:
+			if c.typed > 0 {
+				c.typed--
+				if c.echo {
+					output = append(output, '\b', ' ', '\b')
+				}
+			}
+		case b < ' ':
+			//other control characters aren't shown
+		default:
+			//count characters rather than bytes, backspace removes a whole one
+			if b&0xc0 != 0x80 {
+				c.typed++
+			}
+			if c.echo {
+				output = append(output, b)
+			}
+		}
+	}
+	return output
+}
+
+func (c *sshConn) Write(data []byte) error {
+	c.Lock()
+	pty := c.pty
+	c.Unlock()
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if pty {
+		data = bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	}
+	_, err := c.channel.Write(data)
+	return err
+}
+
+func (c *sshConn) Close() error {
+	c.channel.Close()
+	return c.conn.Close()
+}
+
+func (c *sshConn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *sshConn) Capabilities() capabilities {
+	c.Lock()
+	defer c.Unlock()
+	return capabilities{
+		Color:    terminalColorMode(c.termType),
+		Width:    c.width,
+		Height:   c.height,
+		TermType: c.termType,
+		Paged:    true,
+		AskColor: c.termType == "",
+	}
+}
+
+func (c *sshConn) SetEcho(on bool) error {
+	c.Lock()
+	c.echo = on
+	c.Unlock()
+	return nil
+}
+
+func cmdSSHKey(u *User, inpstr string) bool {
+	fields := strings.SplitN(inpstr, " ", 2)
+	switch fields[0] {
+	case "", "list":
+		u.Lock()
+		keys := make([]string, len(u.SSHKeys))
+		copy(keys, u.SSHKeys)
+		u.Unlock()
+
+		if len(keys) == 0 {
+			u.Write("You have no ssh keys registered.\n")
+			return false
+		}
+
+		output := "\n~BB~FG*** Your ssh keys ***\n\n"
+		for i, line := range keys {
+			key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				continue
+			}
+			output += fmt.Sprintf("%2d) %s %s %s\n", i+1, key.Type(), ssh.FingerprintSHA256(key), comment)
+		}
+		u.Write(output + "\n~BB~FG*** End ***\n\n")
+		return false
+	case "add":
+		if len(fields) < 2 {
+			u.Write("Usage: sshkey add <public key>\n")
+			return false
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1]))
+		if err != nil {
+			u.Write("That doesn't look like a public key, paste a line from your .pub file.\n")
+			return false
+		}
+
+		u.Lock()
+		for _, line := range u.SSHKeys {
+			registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err == nil && bytes.Equal(registered.Marshal(), key.Marshal()) {
+				u.Unlock()
+				u.Write("That key is already registered.\n")
+				return false
+			}
+		}
+		if len(u.SSHKeys) >= sshKeysMax {
+			u.Unlock()
+			u.Write(fmt.Sprintf("You can only register %d keys.\n", sshKeysMax))
+			return false
+		}
+		u.SSHKeys = append(u.SSHKeys, strings.TrimSpace(fields[1]))
+		name := u.Name
+		u.Unlock()
+
+		err = u.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", name, err.Error())
+		}
+		u.Write(fmt.Sprintf("Key %s registered.\n", ssh.FingerprintSHA256(key)))
+		return false
+	case "remove":
+		index := 0
+		if len(fields) == 2 {
+			index, _ = strconv.Atoi(fields[1])
+		}
+
+		u.Lock()
+		if index < 1 || index > len(u.SSHKeys) {
+			total := len(u.SSHKeys)
+			u.Unlock()
+			u.Write(fmt.Sprintf("You have %d key(s), usage: sshkey remove <number>\n", total))
+			return false
+		}
+		u.SSHKeys = append(u.SSHKeys[:index-1], u.SSHKeys[index:]...)
+		name := u.Name
+		u.Unlock()
+
+		err := u.Save()
+		if err != nil {
+			fmt.Printf("unable to save user file for '%s': %s \n", name, err.Error())
+		}
+		u.Write("Key removed.\n")
+		return false
+	}
+
+	u.Write("Usage: sshkey [list]|add <public key>|remove <number>\n")
+	return false
+}
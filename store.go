@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// accounts are kept in a UserStore, picked with user_store in the config.
+// stores deal in each user's saved json, so the User type decides what is
+// kept and the store only decides where. each account's mailbox is kept in
+// the same store, so it moves along with the account.
+const (
+	storeJSON = "json"
+	storeBolt = "bolt"
+
+	defaultBoltPath = "datafiles/users.db"
+	boltOpenTimeout = 5 * time.Second
+)
+
+var errUserNotFound = errors.New("no such user")
+var errUserQuarantined = errors.New("account is in quarantine")
+
+type UserStore interface {
+	Get(name string) ([]byte, error)
+	// Put replaces an account, keeping what it replaced as the backup.
+	Put(name string, data []byte) error
+	Exists(name string) (bool, error)
+	Delete(name string) error
+	// List returns every account name, sorted.
+	List() ([]string, error)
+	// Rename moves an account, its backup and its mail to a new name.
+	Rename(oldName, newName string) error
+	// Backup is the copy of an account that the last Put replaced.
+	Backup(name string) ([]byte, error)
+	// Quarantine moves a damaged account out of the way. the name stays
+	// taken until someone puts it back by hand.
+	Quarantine(name string) error
+	// GetMail is the account's saved mailbox, nil if there isn't one.
+	GetMail(name string) ([]byte, error)
+	// PutMail replaces the account's mailbox, nil data removes it.
+	PutMail(name string, data []byte) error
+	Close() error
+}
+
+var userStore UserStore
+
+// openUserStore opens the named kind of store. an empty path means the
+// default location for that kind.
+func openUserStore(kind string, location string) (UserStore, error) {
+	switch kind {
+	case "", storeJSON:
+		if location == "" {
+			location = userFiles
+		}
+		return newJSONStore(location), nil
+	case storeBolt:
+		if location == "" {
+			location = defaultBoltPath
+		}
+		return newBoltStore(location)
+	}
+	return nil, fmt.Errorf("unknown user store '%s', use %s or %s", kind, storeJSON, storeBolt)
+}
+
+// jsonStore keeps each account in its own file, the way accounts always
+// have been. name.json.bak is the copy before the last save and damaged
+// files are moved into quarantine/.
+type jsonStore struct {
+	dir string
+}
+
+const (
+	backupExt     = ".bak"
+	mailExt       = ".mail"
+	quarantineDir = "quarantine/"
+)
+
+func newJSONStore(dir string) *jsonStore {
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	s := &jsonStore{dir}
+	s.removeTemporary()
+	return s
+}
+
+// removeTemporary clears out saves that never finished, left by a crash.
+func (s *jsonStore) removeTemporary() {
+	leftovers, _ := filepath.Glob(s.dir + "*.tmp")
+	for _, leftover := range leftovers {
+		fmt.Printf("removing unfinished save %s\n", leftover)
+		os.Remove(leftover)
+	}
+}
+
+func (s *jsonStore) path(name string) (string, error) {
+	if validName(name) != nil {
+		return "", errUserNotFound
+	}
+	return s.dir + name + ".json", nil
+}
+
+func (s *jsonStore) quarantined(name string) bool {
+	matches, _ := filepath.Glob(s.dir + quarantineDir + name + ".*.json")
+	return len(matches) > 0
+}
+
+func (s *jsonStore) Get(name string) ([]byte, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		if s.quarantined(name) {
+			return nil, errUserQuarantined
+		}
+		return nil, errUserNotFound
+	}
+	return data, err
+}
+
+// Put never overwrites a file in place, so a crash part way through leaves
+// either the old or the new copy whole. a damaged old copy doesn't replace
+// the backup.
+func (s *jsonStore) Put(name string, data []byte) error {
+	filePath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	previous, err := ioutil.ReadFile(filePath)
+	if err == nil && json.Valid(previous) {
+		if err = writeFileAtomic(filePath+backupExt, previous); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+func (s *jsonStore) Exists(name string) (bool, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return false, nil
+	}
+	_, err = os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return s.quarantined(name), nil
+	}
+	return err == nil, err
+}
+
+func (s *jsonStore) Delete(name string) error {
+	filePath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if os.IsNotExist(err) {
+		return errUserNotFound
+	}
+	//a backup left behind could be restored over a new account of the same name
+	os.Remove(filePath + backupExt)
+	os.Remove(s.dir + name + mailExt)
+	return err
+}
+
+func (s *jsonStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if !file.IsDir() && name != file.Name() && validName(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *jsonStore) Rename(oldName, newName string) error {
+	oldPath, err := s.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.path(newName)
+	if err != nil {
+		return errors.New("that is not a valid name")
+	}
+	if exists, _ := s.Exists(newName); exists {
+		return fmt.Errorf("an account called %s already exists", newName)
+	}
+	err = os.Rename(oldPath, newPath)
+	if os.IsNotExist(err) {
+		return errUserNotFound
+	}
+	if err == nil {
+		os.Rename(oldPath+backupExt, newPath+backupExt)
+		os.Rename(s.dir+oldName+mailExt, s.dir+newName+mailExt)
+	}
+	return err
+}
+
+func (s *jsonStore) Backup(name string) ([]byte, error) {
+	filePath, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filePath + backupExt)
+	if os.IsNotExist(err) {
+		return nil, errUserNotFound
+	}
+	return data, err
+}
+
+func (s *jsonStore) Quarantine(name string) error {
+	filePath, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.dir+quarantineDir, 0700); err != nil {
+		return err
+	}
+	return os.Rename(filePath, fmt.Sprintf("%s%s%s.%s.json", s.dir, quarantineDir, name, time.Now().Format("20060102-150405")))
+}
+
+func (s *jsonStore) GetMail(name string) ([]byte, error) {
+	if validName(name) != nil {
+		return nil, errUserNotFound
+	}
+	data, err := ioutil.ReadFile(s.dir + name + mailExt)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *jsonStore) PutMail(name string, data []byte) error {
+	if validName(name) != nil {
+		return errUserNotFound
+	}
+	mailPath := s.dir + name + mailExt
+	if data == nil {
+		err := os.Remove(mailPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(mailPath, data)
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file beside filePath and renames
+// it over the top, so there is never a half written file under that name.
+func writeFileAtomic(filePath string, data []byte) error {
+	dir := filepath.Dir(filePath)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	//the rename itself only survives a crash once the directory is synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// boltStore keeps every account in a single embedded key/value database.
+// backups and mail are kept in their own buckets, and quarantined accounts
+// under name/time in another.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var usersBucket = []byte("users")
+var backupsBucket = []byte("backups")
+var quarantineBucket = []byte("quarantine")
+var mailBucket = []byte("mail")
+
+func newBoltStore(location string) (*boltStore, error) {
+	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %s", location, err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{usersBucket, backupsBucket, quarantineBucket, mailBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+func boltQuarantined(tx *bolt.Tx, name string) bool {
+	prefix := []byte(name + "/")
+	key, _ := tx.Bucket(quarantineBucket).Cursor().Seek(prefix)
+	return key != nil && bytes.HasPrefix(key, prefix)
+}
+
+func (s *boltStore) Get(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(usersBucket).Get([]byte(name))
+		if value == nil {
+			if boltQuarantined(tx, name) {
+				return errUserQuarantined
+			}
+			return errUserNotFound
+		}
+		//values are only valid inside the transaction
+		data = append([]byte(nil), value...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) Put(name string, data []byte) error {
+	if validName(name) != nil {
+		return errUserNotFound
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		if previous := users.Get([]byte(name)); previous != nil && json.Valid(previous) {
+			if err := tx.Bucket(backupsBucket).Put([]byte(name), append([]byte(nil), previous...)); err != nil {
+				return err
+			}
+		}
+		return users.Put([]byte(name), data)
+	})
+}
+
+func (s *boltStore) Exists(name string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(usersBucket).Get([]byte(name)) != nil || boltQuarantined(tx, name)
+		return nil
+	})
+	return exists, err
+}
+
+func (s *boltStore) Delete(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket.Get([]byte(name)) == nil {
+			return errUserNotFound
+		}
+		for _, other := range [][]byte{backupsBucket, mailBucket} {
+			if err := tx.Bucket(other).Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (s *boltStore) List() ([]string, error) {
+	var names []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(key, value []byte) error {
+			names = append(names, string(key))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func (s *boltStore) Rename(oldName, newName string) error {
+	if validName(newName) != nil {
+		return errors.New("that is not a valid name")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		data := bucket.Get([]byte(oldName))
+		if data == nil {
+			return errUserNotFound
+		}
+		if bucket.Get([]byte(newName)) != nil || boltQuarantined(tx, newName) {
+			return fmt.Errorf("an account called %s already exists", newName)
+		}
+		if err := bucket.Put([]byte(newName), data); err != nil {
+			return err
+		}
+
+		for _, name := range [][]byte{backupsBucket, mailBucket} {
+			other := tx.Bucket(name)
+			if value := other.Get([]byte(oldName)); value != nil {
+				if err := other.Put([]byte(newName), value); err != nil {
+					return err
+				}
+				if err := other.Delete([]byte(oldName)); err != nil {
+					return err
+				}
+			}
+		}
+		return bucket.Delete([]byte(oldName))
+	})
+}
+
+func (s *boltStore) Backup(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(backupsBucket).Get([]byte(name))
+		if value == nil {
+			return errUserNotFound
+		}
+		data = append([]byte(nil), value...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) Quarantine(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		data := users.Get([]byte(name))
+		if data == nil {
+			return errUserNotFound
+		}
+		key := []byte(name + "/" + time.Now().Format("20060102-150405"))
+		if err := tx.Bucket(quarantineBucket).Put(key, append([]byte(nil), data...)); err != nil {
+			return err
+		}
+		return users.Delete([]byte(name))
+	})
+}
+
+func (s *boltStore) GetMail(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(mailBucket).Get([]byte(name)); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) PutMail(name string, data []byte) error {
+	if validName(name) != nil {
+		return errUserNotFound
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if data == nil {
+			return tx.Bucket(mailBucket).Delete([]byte(name))
+		}
+		return tx.Bucket(mailBucket).Put([]byte(name), data)
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// migrateStore copies every account and its mail from one store to another, for example
+// "gotalker migrate-store json:userfiles/ bolt:datafiles/users.db". accounts
+// already in the destination are left alone.
+func migrateStore(from string, to string) error {
+	open := func(spec string) (UserStore, error) {
+		kind, location := spec, ""
+		if colon := strings.Index(spec, ":"); colon != -1 {
+			kind, location = spec[:colon], spec[colon+1:]
+		}
+		return openUserStore(kind, location)
+	}
+
+	source, err := open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := open(to)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	names, err := source.List()
+	if err != nil {
+		return err
+	}
+
+	copied, skipped := 0, 0
+	for _, name := range names {
+		exists, err := destination.Exists(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Printf("skipping %s, it is already in %s\n", name, to)
+			skipped++
+			continue
+		}
+
+		data, err := source.Get(name)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", name, err.Error())
+		}
+		if err = destination.Put(name, data); err != nil {
+			return fmt.Errorf("unable to write %s: %s", name, err.Error())
+		}
+
+		mail, err := source.GetMail(name)
+		if err == nil && mail != nil {
+			err = destination.PutMail(name, mail)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to copy mail for %s: %s", name, err.Error())
+		}
+		copied++
+	}
+
+	fmt.Printf("Copied %d account(s) from %s to %s, %d skipped.\n", copied, from, to, skipped)
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// storeKinds opens an empty store of each kind for a test.
+var storeKinds = []struct {
+	name string
+	open func(t *testing.T) UserStore
+}{
+	{storeJSON, func(t *testing.T) UserStore {
+		return newJSONStore(t.TempDir())
+	}},
+	{storeBolt, func(t *testing.T) UserStore {
+		s, err := newBoltStore(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}},
+}
+
+func TestUserStore(t *testing.T) {
+	for _, kind := range storeKinds {
+		s := kind.open(t)
+
+		if _, err := s.Get("alice"); err != errUserNotFound {
+			t.Errorf("%s: Get of a missing user returned %v, want errUserNotFound", kind.name, err)
+		}
+		if err := s.Put("no good", []byte(`{}`)); err == nil {
+			t.Errorf("%s: Put accepted an invalid name", kind.name)
+		}
+
+		s.Put("bob", []byte(`{"name":"bob"}`))
+		s.Put("alice", []byte(`{"level":1}`))
+		s.Put("alice", []byte(`{"level":2}`))
+		s.PutMail("alice", []byte(`{"messages":[]}`))
+
+		data, err := s.Get("alice")
+		if err != nil || string(data) != `{"level":2}` {
+			t.Errorf("%s: Get() = %s, %v", kind.name, data, err)
+		}
+		data, err = s.Backup("alice")
+		if err != nil || string(data) != `{"level":1}` {
+			t.Errorf("%s: Backup() = %s, %v", kind.name, data, err)
+		}
+		if names, _ := s.List(); !reflect.DeepEqual(names, []string{"alice", "bob"}) {
+			t.Errorf("%s: List() = %q", kind.name, names)
+		}
+
+		//the backup and mail go with the account
+		if err = s.Rename("alice", "bob"); err == nil {
+			t.Errorf("%s: Rename over an existing account was allowed", kind.name)
+		}
+		if err = s.Rename("alice", "carol"); err != nil {
+			t.Fatalf("%s: Rename() = %v", kind.name, err)
+		}
+		if exists, _ := s.Exists("alice"); exists {
+			t.Errorf("%s: alice still exists after the rename", kind.name)
+		}
+		data, _ = s.Get("carol")
+		backup, _ := s.Backup("carol")
+		mail, _ := s.GetMail("carol")
+		if string(data) != `{"level":2}` || string(backup) != `{"level":1}` || string(mail) != `{"messages":[]}` {
+			t.Errorf("%s: after the rename got %s, backup %s and mail %s", kind.name, data, backup, mail)
+		}
+		if mail, _ = s.GetMail("alice"); mail != nil {
+			t.Errorf("%s: mail %s was left under the old name", kind.name, mail)
+		}
+
+		//nothing is left behind for a new account of the same name
+		if err = s.Delete("carol"); err != nil {
+			t.Errorf("%s: Delete() = %v", kind.name, err)
+		}
+		if err = s.Delete("carol"); err != errUserNotFound {
+			t.Errorf("%s: second Delete() = %v, want errUserNotFound", kind.name, err)
+		}
+		backup, _ = s.Backup("carol")
+		mail, _ = s.GetMail("carol")
+		if backup != nil || mail != nil {
+			t.Errorf("%s: Delete left backup %s and mail %s", kind.name, backup, mail)
+		}
+
+		//a quarantined account still exists, so the name can't be taken
+		if err = s.Quarantine("bob"); err != nil {
+			t.Errorf("%s: Quarantine() = %v", kind.name, err)
+		}
+		if _, err = s.Get("bob"); err != errUserQuarantined {
+			t.Errorf("%s: Get of a quarantined user returned %v, want errUserQuarantined", kind.name, err)
+		}
+		if exists, _ := s.Exists("bob"); !exists {
+			t.Errorf("%s: a quarantined user doesn't exist", kind.name)
+		}
+		s.Close()
+	}
+}
+
+func TestUserStoreMail(t *testing.T) {
+	for _, kind := range storeKinds {
+		s := kind.open(t)
+
+		tests := []struct {
+			name string
+			put  []byte
+			want []byte
+		}{
+			{"first", []byte("one"), []byte("one")},
+			{"replaced", []byte("two"), []byte("two")},
+			{"removed", nil, nil},
+			{"removed again", nil, nil},
+		}
+
+		for _, test := range tests {
+			if err := s.PutMail("alice", test.put); err != nil {
+				t.Errorf("%s %s: PutMail() = %v", kind.name, test.name, err)
+			}
+			if got, err := s.GetMail("alice"); err != nil || string(got) != string(test.want) || (got == nil) != (test.want == nil) {
+				t.Errorf("%s %s: GetMail() = %q, %v, want %q", kind.name, test.name, got, err, test.want)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestMigrateStore(t *testing.T) {
+	dir := t.TempDir()
+	source := newJSONStore(filepath.Join(dir, "users"))
+	source.Put("alice", []byte(`{"name":"alice"}`))
+	source.PutMail("alice", []byte("alice's mail"))
+	source.Put("bob", []byte(`{"name":"bob"}`))
+
+	//accounts already in the destination are kept
+	boltPath := filepath.Join(dir, "users.db")
+	destination, err := newBoltStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination.Put("bob", []byte(`{"name":"bob","level":3}`))
+	destination.Close()
+
+	err = migrateStore("json:"+filepath.Join(dir, "users"), "bolt:"+boltPath)
+	if err != nil {
+		t.Fatalf("migrateStore() = %v", err)
+	}
+
+	destination, err = newBoltStore(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+
+	tests := []struct {
+		name string
+		data string
+		mail string
+	}{
+		{"alice", `{"name":"alice"}`, "alice's mail"},
+		{"bob", `{"name":"bob","level":3}`, ""},
+	}
+	for _, test := range tests {
+		data, err := destination.Get(test.name)
+		mail, _ := destination.GetMail(test.name)
+		if err != nil || string(data) != test.data || string(mail) != test.mail {
+			t.Errorf("%s: got %s, %v and mail %q, want %s and mail %q", test.name, data, err, mail, test.data, test.mail)
+		}
+	}
+
+	if err = migrateStore("json", "nothing"); err == nil {
+		t.Errorf("migrating to an unknown store worked")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	telnetTTypeIs   = 0
+	telnetTTypeSend = 1
+
+	//NAWS and TTYPE need far less, anything longer is dropped
+	telnetSBMax = 64
+
+	defaultWidth  = 80
+	defaultHeight = 24
+	minWidth      = 40
+	maxWidth      = 250
+	minHeight     = 10
+	maxHeight     = 200
+)
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSB
+	telnetStateSBIAC
+)
+
+// telnet tracks option negotiation for a single network connection and
+// strips protocol sequences out of the data stream.
+type telnet struct {
+	state    int
+	command  byte
+	sbOption byte
+	sbData   []byte
+	sent     map[byte]byte
+	width    int
+	height   int
+	termType string
+}
+
+func newTelnet() *telnet {
+	return &telnet{sent: make(map[byte]byte)}
+}
+
+// negotiate returns the options offered to a client when it first connects.
+func (t *telnet) negotiate() []byte {
+	return append(t.ask(telnetDO, telnetOptNAWS), t.ask(telnetDO, telnetOptTType)...)
+}
+
+// ask builds a request for an option, remembering it so the client's answer
+// is treated as an acknowledgement rather than a new request.
+func (t *telnet) ask(command, option byte) []byte {
+	if t.sent[option] == command {
+		return nil
+	}
+	t.sent[option] = command
+	return []byte{telnetIAC, command, option}
+}
+
+// parse splits raw socket input into user data and any replies that need to
+// be sent back. state is kept between calls, so sequences may span reads.
+func (t *telnet) parse(input []byte) (data []byte, reply []byte) {
+	for _, b := range input {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				t.state = telnetStateIAC
+			} else if b != 0 {
+				data = append(data, b)
+			}
+		case telnetStateIAC:
+			switch b {
+			case telnetIAC:
+				data = append(data, b)
+				t.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.command = b
+				t.state = telnetStateOption
+			case telnetSB:
+				t.sbData = t.sbData[:0]
+				t.state = telnetStateOption
+				t.command = telnetSB
+			default:
+				//NOP, GA, AYT and friends need nothing from us
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			if t.command == telnetSB {
+				t.sbOption = b
+				t.state = telnetStateSB
+			} else {
+				reply = append(reply, t.option(t.command, b)...)
+				t.state = telnetStateData
+			}
+		case telnetStateSB:
+			if b == telnetIAC {
+				t.state = telnetStateSBIAC
+			} else {
+				t.sbAppend(b)
+			}
+		case telnetStateSBIAC:
+			switch b {
+			case telnetSE:
+				t.subnegotiation()
+				t.state = telnetStateData
+			case telnetIAC:
+				t.state = telnetStateSB
+				t.sbAppend(b)
+			default:
+				//malformed, drop the subnegotiation
+				t.state = telnetStateData
+			}
+		}
+	}
+
+	return data, reply
+}
+
+// sbAppend adds a byte to the subnegotiation being read, giving up on it if
+// it grows past telnetSBMax so a client can't make us buffer without end.
+func (t *telnet) sbAppend(b byte) {
+	if len(t.sbData) >= telnetSBMax {
+		t.sbData = t.sbData[:0]
+		t.state = telnetStateData
+		return
+	}
+	t.sbData = append(t.sbData, b)
+}
+
+func (t *telnet) option(command, option byte) []byte {
+	switch command {
+	case telnetWILL:
+		switch option {
+		case telnetOptNAWS:
+			return t.ask(telnetDO, option)
+		case telnetOptTType:
+			return append(t.ask(telnetDO, option), telnetIAC, telnetSB, telnetOptTType, telnetTTypeSend, telnetIAC, telnetSE)
+		}
+		return t.ask(telnetDONT, option)
+	case telnetDO:
+		switch option {
+		case telnetOptSGA:
+			return t.ask(telnetWILL, option)
+		case telnetOptEcho:
+			//echo is only switched on by us for passwords
+			return nil
+		}
+		return t.ask(telnetWONT, option)
+	case telnetWONT:
+		//refusals are never answered, just remembered
+		t.sent[option] = telnetDONT
+	case telnetDONT:
+		t.sent[option] = telnetWONT
+	}
+	return nil
+}
+
+func (t *telnet) subnegotiation() {
+	switch t.sbOption {
+	case telnetOptNAWS:
+		if len(t.sbData) < 4 {
+			return
+		}
+		t.width = int(t.sbData[0])<<8 | int(t.sbData[1])
+		t.height = int(t.sbData[2])<<8 | int(t.sbData[3])
+	case telnetOptTType:
+		if len(t.sbData) < 1 || t.sbData[0] != telnetTTypeIs {
+			return
+		}
+		t.termType = strings.ToLower(string(t.sbData[1:]))
+	}
+}
+
+func (t *telnet) echoOff() []byte {
+	t.sent[telnetOptEcho] = telnetWILL
+	return []byte{telnetIAC, telnetWILL, telnetOptEcho}
+}
+
+func (t *telnet) echoOn() []byte {
+	t.sent[telnetOptEcho] = telnetWONT
+	return []byte{telnetIAC, telnetWONT, telnetOptEcho}
+}
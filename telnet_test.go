@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// parseEach feeds input to parse one read at a time, however it is split.
+func parseEach(t *telnet, reads ...[]byte) (data []byte, reply []byte) {
+	for _, input := range reads {
+		d, r := t.parse(input)
+		data = append(data, d...)
+		reply = append(reply, r...)
+	}
+	return data, reply
+}
+
+// splitBytes breaks input into single byte reads.
+func splitBytes(input []byte) [][]byte {
+	var reads [][]byte
+	for i := range input {
+		reads = append(reads, input[i:i+1])
+	}
+	return reads
+}
+
+func TestTelnetData(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"plain", []byte("hello\r\n"), "hello\r\n"},
+		{"escaped iac", []byte{'a', telnetIAC, telnetIAC, 'b'}, "a\xffb"},
+		{"nul", []byte{'a', 0, 'b'}, "ab"},
+		{"nop", []byte{'a', telnetIAC, 241, 'b'}, "ab"},
+		{"option", []byte{'a', telnetIAC, telnetDONT, telnetOptEcho, 'b'}, "ab"},
+	}
+
+	for _, test := range tests {
+		data, _ := newTelnet().parse(test.input)
+		if string(data) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, data, test.want)
+		}
+
+		data, _ = parseEach(newTelnet(), splitBytes(test.input)...)
+		if string(data) != test.want {
+			t.Errorf("%s a byte at a time: got %q, want %q", test.name, data, test.want)
+		}
+	}
+}
+
+func TestTelnetNAWS(t *testing.T) {
+	naws := []byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 132, 0, 50, telnetIAC, telnetSE}
+
+	tests := []struct {
+		name  string
+		reads [][]byte
+	}{
+		{"one read", [][]byte{naws}},
+		{"split", [][]byte{naws[:3], naws[3:5], naws[5:8], naws[8:]}},
+		{"byte at a time", splitBytes(naws)},
+	}
+
+	for _, test := range tests {
+		tn := newTelnet()
+		data, _ := parseEach(tn, test.reads...)
+		if len(data) != 0 || tn.width != 132 || tn.height != 50 {
+			t.Errorf("%s: got %dx%d and data %q, want 132x50", test.name, tn.width, tn.height, data)
+		}
+	}
+
+	//255 has to be doubled inside a subnegotiation
+	tn := newTelnet()
+	tn.parse([]byte{telnetIAC, telnetSB, telnetOptNAWS, 0, telnetIAC, telnetIAC, 0, 30, telnetIAC, telnetSE})
+	if tn.width != 255 || tn.height != 30 {
+		t.Errorf("escaped width: got %dx%d, want 255x30", tn.width, tn.height)
+	}
+}
+
+func TestTelnetTType(t *testing.T) {
+	ttype := append([]byte{telnetIAC, telnetSB, telnetOptTType, telnetTTypeIs}, "XTERM-256COLOR"...)
+	ttype = append(ttype, telnetIAC, telnetSE)
+
+	for _, reads := range [][][]byte{{ttype}, {ttype[:2], ttype[2:9], ttype[9:]}, splitBytes(ttype)} {
+		tn := newTelnet()
+		data, _ := parseEach(tn, reads...)
+		if len(data) != 0 || tn.termType != "xterm-256color" {
+			t.Errorf("split into %d reads: got %q and data %q", len(reads), tn.termType, data)
+		}
+	}
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	tn := newTelnet()
+	offered := tn.negotiate()
+	want := []byte{telnetIAC, telnetDO, telnetOptNAWS, telnetIAC, telnetDO, telnetOptTType}
+	if !bytes.Equal(offered, want) {
+		t.Fatalf("negotiate() = %v, want %v", offered, want)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{"naws accepted", []byte{telnetIAC, telnetWILL, telnetOptNAWS}, nil},
+		{"ttype accepted", []byte{telnetIAC, telnetWILL, telnetOptTType},
+			[]byte{telnetIAC, telnetSB, telnetOptTType, telnetTTypeSend, telnetIAC, telnetSE}},
+		{"unknown offer", []byte{telnetIAC, telnetWILL, 99}, []byte{telnetIAC, telnetDONT, 99}},
+		{"unknown offer again", []byte{telnetIAC, telnetWILL, 99}, nil},
+		{"sga", []byte{telnetIAC, telnetDO, telnetOptSGA}, []byte{telnetIAC, telnetWILL, telnetOptSGA}},
+		{"unknown request", []byte{telnetIAC, telnetDO, 99}, []byte{telnetIAC, telnetWONT, 99}},
+		{"echo", []byte{telnetIAC, telnetDO, telnetOptEcho}, nil},
+	}
+
+	for _, test := range tests {
+		_, reply := tn.parse(test.input)
+		if !bytes.Equal(reply, test.want) {
+			t.Errorf("%s: replied %v, want %v", test.name, reply, test.want)
+		}
+	}
+}
+
+func TestTelnetSubnegotiationLimit(t *testing.T) {
+	tn := newTelnet()
+	tn.parse([]byte{telnetIAC, telnetSB, telnetOptTType})
+	for i := 0; i < 1000; i++ {
+		tn.parse([]byte(strings.Repeat("a", 2048)))
+		if len(tn.sbData) > telnetSBMax {
+			t.Fatalf("subnegotiation grew to %d bytes", len(tn.sbData))
+		}
+	}
+	if tn.state != telnetStateData {
+		t.Errorf("state is %d after an over long subnegotiation, want data", tn.state)
+	}
+
+	//the connection carries on working afterwards
+	tn.parse([]byte{telnetIAC, telnetSB, telnetOptNAWS, 0, 100, 0, 40, telnetIAC, telnetSE})
+	if tn.width != 100 || tn.height != 40 {
+		t.Errorf("got %dx%d after an over long subnegotiation, want 100x40", tn.width, tn.height)
+	}
+}
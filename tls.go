@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// the tls telnet port and the https port share one certificate. handshakes
+// always use whatever was loaded last, so a SIGHUP can swap in a renewed
+// certificate without dropping anyone.
+var tlsListener net.Listener
+var httpsListener net.Listener
+
+var certificate *tls.Certificate
+var certificateLock sync.Mutex
+
+var tlsConfig = &tls.Config{
+	MinVersion:     tls.VersionTLS12,
+	GetCertificate: getCertificate,
+}
+
+func loadCertificate(certPath, keyPath string) error {
+	if certPath == "" || keyPath == "" {
+		return errors.New("tls_cert and tls_key both need to be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	certificateLock.Lock()
+	certificate = &cert
+	certificateLock.Unlock()
+	return nil
+}
+
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificateLock.Lock()
+	defer certificateLock.Unlock()
+	if certificate == nil {
+		return nil, errors.New("no certificate has been loaded")
+	}
+	return certificate, nil
+}
+
+// tlsEnabled is true when either of the encrypted ports is switched on.
+func tlsEnabled() bool {
+	cfg := getConfig()
+	return cfg.TLSPort != 0 || cfg.HTTPSPort != 0
+}
+
+// serveTelnet accepts telnet connections until the listener is closed.
+func serveTelnet(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("unable to accept socket", err)
+			continue
+		}
+
+		go acceptHTTPConnection(conn)
+	}
+}
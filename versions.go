@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// every saved account records the version of the layout it was written
+// with. when fields change, bump userFileVersion and add a migration that
+// takes a record from the version before to the new one.
+const userFileVersion = 1
+
+var errNewerUserFile = errors.New("saved by a newer version of the talker")
+
+// userMigrations[n] upgrades a record from version n to n+1.
+var userMigrations = []func(record map[string]json.RawMessage) error{
+	//version 0 saved tells under PastTells with every field lost, so there
+	//is nothing worth keeping
+	func(record map[string]json.RawMessage) error {
+		delete(record, "PastTells")
+		return nil
+	},
+}
+
+// upgradeUser brings a saved account up to the current version, checking it
+// can be read on the way.
+func upgradeUser(data []byte) ([]byte, error) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if saved, ok := record["version"]; ok {
+		if err := json.Unmarshal(saved, &version); err != nil || version < 0 {
+			return nil, fmt.Errorf("version %s is not valid", string(saved))
+		}
+	}
+	if version > userFileVersion {
+		return nil, fmt.Errorf("%w (version %d)", errNewerUserFile, version)
+	}
+
+	for ; version < userFileVersion; version++ {
+		if err := userMigrations[version](record); err != nil {
+			return nil, fmt.Errorf("unable to upgrade from version %d: %s", version, err.Error())
+		}
+	}
+	record["version"] = json.RawMessage(strconv.Itoa(userFileVersion))
+
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var check User
+	if err = json.Unmarshal(upgraded, &check); err != nil {
+		return nil, err
+	}
+	return upgraded, nil
+}
+
+// recoverUser deals with an account that can't be read. the damaged copy is
+// quarantined and the backup is put back if it can be read, otherwise the
+// account is left for staff to repair.
+func recoverUser(name string, readErr error) ([]byte, error) {
+	writeAudit("the account for %s is unreadable: %s", name, readErr.Error())
+
+	err := userStore.Quarantine(name)
+	if err != nil {
+		writeAudit("unable to quarantine the account for %s: %s", name, err.Error())
+		return nil, readErr
+	}
+
+	backup, err := userStore.Backup(name)
+	if err == nil {
+		var upgraded []byte
+		upgraded, err = upgradeUser(backup)
+		if err == nil {
+			err = userStore.Put(name, backup)
+		}
+		if err == nil {
+			writeAudit("the account for %s has been quarantined and restored from its backup", name)
+			return upgraded, nil
+		}
+	}
+
+	writeAudit("the account for %s has been quarantined, there is no usable backup", name)
+	return nil, errUserQuarantined
+}
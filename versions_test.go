@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestUpgradeUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+		keep    string
+		drop    string
+	}{
+		{"version 0", `{"name":"bob","PastTells":[{},{}]}`, false, "name", "PastTells"},
+		{"version 1", `{"version":1,"name":"bob","past_tells":[{"message":"hi"}]}`, false, "past_tells", ""},
+		{"not json", `{"name":`, true, "", ""},
+		{"bad version", `{"version":"one"}`, true, "", ""},
+		{"negative version", `{"version":-1}`, true, "", ""},
+		{"wrong type", `{"version":1,"level":"high"}`, true, "", ""},
+	}
+
+	for _, test := range tests {
+		upgraded, err := upgradeUser([]byte(test.input))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: upgraded to %s, want an error", test.name, upgraded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+
+		var record map[string]json.RawMessage
+		json.Unmarshal(upgraded, &record)
+		if string(record["version"]) != "1" {
+			t.Errorf("%s: upgraded to version %s, want 1", test.name, record["version"])
+		}
+		if _, ok := record[test.keep]; !ok {
+			t.Errorf("%s: %s was lost in %s", test.name, test.keep, upgraded)
+		}
+		if _, ok := record[test.drop]; ok && test.drop != "" {
+			t.Errorf("%s: %s was kept in %s", test.name, test.drop, upgraded)
+		}
+	}
+
+	_, err := upgradeUser([]byte(`{"version":2}`))
+	if !errors.Is(err, errNewerUserFile) {
+		t.Errorf("a newer file returned %v, want errNewerUserFile", err)
+	}
+}
+
+func TestRecoverUser(t *testing.T) {
+	//recovering writes to the audit log under the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	saved := userStore
+	t.Cleanup(func() {
+		userStore = saved
+		os.Chdir(wd)
+	})
+
+	tests := []struct {
+		name  string
+		saves []string
+		want  string
+	}{
+		{"good backup", []string{`{"level":1}`, `{"level":`}, `{"level":1}`},
+		{"no backup", []string{`{"level":`}, ""},
+		{"unreadable backup", []string{`{"level":"one"}`, `{"level":"two"}`}, ""},
+	}
+
+	for _, kind := range storeKinds {
+		userStore = kind.open(t)
+
+		for _, test := range tests {
+			for _, data := range test.saves {
+				userStore.Put("alice", []byte(data))
+			}
+
+			recovered, err := recoverUser("alice", errors.New("damaged"))
+			if test.want == "" {
+				if err != errUserQuarantined {
+					t.Errorf("%s %s: got %s, %v, want errUserQuarantined", kind.name, test.name, recovered, err)
+				}
+				if _, err = userStore.Get("alice"); err != errUserQuarantined {
+					t.Errorf("%s %s: Get() after recovery returned %v, want errUserQuarantined", kind.name, test.name, err)
+				}
+			} else {
+				var u User
+				if err != nil || json.Unmarshal(recovered, &u) != nil || u.Version != userFileVersion {
+					t.Errorf("%s %s: got %s, %v, want the upgraded backup", kind.name, test.name, recovered, err)
+				}
+				if data, _ := userStore.Get("alice"); string(data) != test.want {
+					t.Errorf("%s %s: the store holds %s, want the backup %s", kind.name, test.name, data, test.want)
+				}
+			}
+
+			//start the next case with a clean account
+			userStore.Delete("alice")
+		}
+		userStore.Close()
+	}
+}